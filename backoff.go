@@ -0,0 +1,68 @@
+package claude
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// BackoffStrategy decides how long to wait before a retry. Attempts are
+// numbered from 1 for the first retry.
+type BackoffStrategy interface {
+	NextDelay(attempt int) time.Duration
+}
+
+// ConstantBackoff waits the same delay before every attempt.
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+// NextDelay returns Delay.
+func (b ConstantBackoff) NextDelay(attempt int) time.Duration {
+	return b.Delay
+}
+
+// ExponentialBackoff multiplies the delay by Multiplier after every attempt,
+// starting from Initial and capped at Max.
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Multiplier float64       // defaults to 2
+	Max        time.Duration // 0 for no cap
+}
+
+// NextDelay returns Initial * Multiplier^(attempt-1), capped at Max.
+func (b ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	multiplier := b.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	delay := float64(b.Initial) * math.Pow(multiplier, float64(attempt-1))
+	if b.Max > 0 && delay > float64(b.Max) {
+		return b.Max
+	}
+	if delay > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// JitterBackoff randomizes the delays of another strategy ("full jitter"),
+// spreading out retries from many clients that failed at the same time.
+type JitterBackoff struct {
+	Base BackoffStrategy
+	// Random returns a value in [0, 1); defaults to math/rand.Float64
+	Random func() float64
+}
+
+// NextDelay returns a random delay between 0 and Base's delay.
+func (b JitterBackoff) NextDelay(attempt int) time.Duration {
+	random := b.Random
+	if random == nil {
+		random = rand.Float64
+	}
+	return time.Duration(random() * float64(b.Base.NextDelay(attempt)))
+}
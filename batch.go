@@ -0,0 +1,72 @@
+package claude
+
+import (
+	"context"
+	"sync"
+)
+
+// BatchResult holds the outcome of one prompt in a Batch.
+type BatchResult struct {
+	// Prompt is the input prompt; results are in the same order as the
+	// prompts passed to Batch.
+	Prompt string
+	// Messages holds every message received for the prompt.
+	Messages []Message
+	// Err is set if the prompt's query failed.
+	Err error
+}
+
+// Batch runs independent queries for each prompt and returns their results
+// in input order. At most options.MaxConcurrency queries run at once
+// (unlimited when zero).
+//
+// A failing prompt does not stop the batch; its error is recorded in its
+// BatchResult. The returned error is non-nil only if ctx is done before
+// the batch completes, in which case prompts that never started carry
+// ctx's error.
+//
+// Example:
+//
+//	opts := NewOptions()
+//	opts.MaxConcurrency = 4
+//	results, err := Batch(ctx, []string{"Summarize a.go", "Summarize b.go"}, opts)
+func Batch(ctx context.Context, prompts []string, options *Options) ([]BatchResult, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+
+	limit := options.MaxConcurrency
+	if limit <= 0 || limit > len(prompts) {
+		limit = len(prompts)
+	}
+	slots := make(chan struct{}, limit)
+
+	results := make([]BatchResult, len(prompts))
+	var wg sync.WaitGroup
+	for i, prompt := range prompts {
+		results[i].Prompt = prompt
+
+		wg.Add(1)
+		go func(result *BatchResult) {
+			defer wg.Done()
+
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				result.Err = ctx.Err()
+				return
+			}
+
+			messages, err := Query(ctx, result.Prompt, options)
+			if err != nil {
+				result.Err = err
+				return
+			}
+			result.Messages, result.Err = collectMessages(messages)
+		}(&results[i])
+	}
+	wg.Wait()
+
+	return results, ctx.Err()
+}
@@ -0,0 +1,45 @@
+package claude
+
+// CacheStats aggregates prompt cache usage across the result messages a
+// Client has received.
+type CacheStats struct {
+	InputTokens              int // uncached input tokens
+	CacheReadInputTokens     int
+	CacheCreationInputTokens int
+	Results                  int // result messages counted
+}
+
+// HitRatio returns the fraction of input tokens served from the cache, or 0
+// if no input tokens were reported.
+func (s CacheStats) HitRatio() float64 {
+	total := s.InputTokens + s.CacheReadInputTokens + s.CacheCreationInputTokens
+	if total == 0 {
+		return 0
+	}
+	return float64(s.CacheReadInputTokens) / float64(total)
+}
+
+// add accumulates the token counts from a result message's usage.
+func (s *CacheStats) add(usage map[string]any) {
+	s.Results++
+	s.InputTokens += usageTokens(usage, "input_tokens")
+	s.CacheReadInputTokens += usageTokens(usage, "cache_read_input_tokens")
+	s.CacheCreationInputTokens += usageTokens(usage, "cache_creation_input_tokens")
+}
+
+// usageTokens reads a token count from a usage map, treating absent or
+// malformed fields as 0.
+func usageTokens(usage map[string]any, key string) int {
+	if val, ok := usage[key].(float64); ok {
+		return int(val)
+	}
+	return 0
+}
+
+// CacheStats returns the cache usage accumulated from every ResultMessage
+// received so far. It is safe to call while messages are being received.
+func (c *Client) CacheStats() CacheStats {
+	c.cacheMu.Lock()
+	defer c.cacheMu.Unlock()
+	return c.cacheStats
+}
@@ -0,0 +1,84 @@
+package claude
+
+import (
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by Connect, and so Query, while the circuit
+// breaker is open after repeated failures to start the CLI.
+var ErrCircuitOpen = &SDKError{message: "circuit breaker open: the CLI failed to start repeatedly"}
+
+// circuitBreaker fails connections fast after repeated Connect failures,
+// so a server doesn't keep spawning a CLI that can't start, e.g. because
+// its authentication expired.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int           // consecutive failures that open the circuit, 0 when disabled
+	window    time.Duration // failures must fall within this of the first, 0 for any
+	cooldown  time.Duration // how long the circuit stays open
+
+	failures     int
+	firstFailure time.Time
+	openUntil    time.Time
+	now          func() time.Time
+}
+
+// breaker is the process-wide circuit breaker shared by every Client.
+var breaker = &circuitBreaker{now: time.Now}
+
+// ConfigureCircuitBreaker enables the process-wide circuit breaker for
+// Connect and Query. After threshold consecutive Connect failures, with all
+// of them within window of the first (any time apart when window is 0),
+// connections fail fast with ErrCircuitOpen for cooldown. After the
+// cooldown connections are attempted again: a success closes the circuit,
+// and a failure opens it for another cooldown.
+//
+// The breaker is disabled by default; a threshold of 0 disables it again.
+// Validation errors don't count as failures.
+//
+// Example:
+//
+//	claude.ConfigureCircuitBreaker(5, time.Minute, 30*time.Second)
+func ConfigureCircuitBreaker(threshold int, window, cooldown time.Duration) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	breaker.threshold = threshold
+	breaker.window = window
+	breaker.cooldown = cooldown
+	breaker.failures = 0
+	breaker.openUntil = time.Time{}
+}
+
+// allow returns ErrCircuitOpen while the circuit is open.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold > 0 && b.now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// record counts the outcome of a connection attempt.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.threshold <= 0 {
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		return
+	}
+
+	now := b.now()
+	if b.failures == 0 || (b.window > 0 && b.failures < b.threshold && now.Sub(b.firstFailure) > b.window) {
+		b.failures = 0
+		b.firstFailure = now
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
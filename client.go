@@ -2,8 +2,12 @@ package claude
 
 import (
 	"context"
+	"fmt"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	
 	"github.com/davlia/claude-code-sdk-go/internal/transport"
 )
@@ -62,6 +66,59 @@ type Client struct {
 	options   *Options
 	transport transport.Transport
 	mu        sync.Mutex
+
+	// Delivery gating for Pause/Resume
+	pauseMu sync.Mutex
+	resumed chan struct{} // non-nil while paused
+
+	// Messages queued by Replay and by prompt echoes, see Options.EchoPrompts
+	replayMu    sync.Mutex
+	replay      []MessageResult
+	replayReady chan struct{}
+
+	// Number of live messages delivered on this connection, for
+	// Options.MaxMessages
+	delivered atomic.Int64
+
+	// Set by StopAfterTurn until the next result is delivered
+	stopAfterTurn atomic.Bool
+
+	// Tool uses seen from the assistant that have not been answered yet
+	toolUseMu  sync.Mutex
+	toolUseIDs []string
+
+	// Callback registered with OnTurnComplete
+	turnMu         sync.Mutex
+	onTurnComplete func(*ResultMessage)
+
+	// Cache usage aggregated from result messages
+	cacheMu    sync.Mutex
+	cacheStats CacheStats
+
+	// Lifecycle timestamps of the current connection
+	timingsMu sync.Mutex
+	timings   Timings
+
+	// Closed once the CLI is ready or output ends, see WaitReady. The
+	// generation changes on each Connect, so receivers left over from an
+	// earlier connection can't settle the current one's readiness
+	readyMu      sync.Mutex
+	ready        chan struct{}
+	readyErr     error
+	readyGen     uint64
+	handshakeGen uint64 // last generation to start an initialize handshake
+
+	// SIGINT handling installed by EnableCtrlCInterrupt, and the presses
+	// received since the last response ended
+	ctrlCMu      sync.Mutex
+	stopCtrlC    func()
+	ctrlCPresses atomic.Int32
+}
+
+// newTransport creates the transport used by Connect. Tests replace it to
+// avoid spawning the CLI.
+var newTransport = func(prompt MessageStream, options *transport.Options) transport.Transport {
+	return transport.NewSubprocessCLITransport(prompt, options)
 }
 
 // NewClient creates a new Claude SDK client
@@ -71,13 +128,26 @@ func NewClient(options *Options) *Client {
 	}
 	os.Setenv("CLAUDE_CODE_ENTRYPOINT", "sdk-go-client")
 	return &Client{
-		options: options,
+		options:     options,
+		replayReady: make(chan struct{}, 1),
 	}
 }
 
 // Connect establishes a connection to Claude with an optional prompt or message stream.
 // If prompt is nil, connects with an empty stream for interactive use.
 func (c *Client) Connect(ctx context.Context, prompt any) error {
+	// Wait for a slot under SetMaxConcurrentProcesses, held until Disconnect.
+	// The wait happens before locking so it doesn't block the client's other methods
+	if err := processes.acquire(ctx); err != nil {
+		return err
+	}
+	connected := false
+	defer func() {
+		if !connected {
+			processes.release()
+		}
+	}()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -85,6 +155,10 @@ func (c *Client) Connect(ctx context.Context, prompt any) error {
 		return NewCLIConnectionError("Already connected")
 	}
 
+	if err := c.options.Validate(); err != nil {
+		return err
+	}
+
 	// Convert prompt to MessageStream
 	var stream MessageStream
 	switch p := prompt.(type) {
@@ -92,48 +166,71 @@ func (c *Client) Connect(ctx context.Context, prompt any) error {
 		// Empty stream for interactive use
 		stream = &emptyStream{}
 	case string:
-		stream = &stringPrompt{prompt: p}
+		if err := c.options.checkPromptTokens(p); err != nil {
+			return err
+		}
+		// Answering permission prompts and sending seed messages need
+		// stdin, so the prompt is streamed
+		streaming := c.options.MCPPermissionHandler != nil || len(c.options.SeedMessages) > 0
+		stream = &stringPrompt{prompt: p, streaming: streaming}
 	case MessageStream:
 		stream = p
 	default:
 		return &SDKError{message: "prompt must be nil, a string, or MessageStream"}
 	}
 
-	// Convert claude.Options to transport.Options
-	transportOptions := &transport.Options{
-		Model:                    c.options.Model,
-		SystemPrompt:             c.options.SystemPrompt,
-		AppendSystemPrompt:       c.options.AppendSystemPrompt,
-		Cwd:                      c.options.Cwd,
-		AllowedTools:             c.options.AllowedTools,
-		DisallowedTools:          c.options.DisallowedTools,
-		MaxTurns:                 c.options.MaxTurns,
-		PermissionPromptToolName: c.options.PermissionPromptToolName,
-		PermissionMode:           string(c.options.PermissionMode),
-		ContinueConversation:     c.options.ContinueConversation,
-		Resume:                   c.options.Resume,
-	}
-	
-	// Convert MCPServers if present
-	if c.options.MCPServers != nil {
-		transportOptions.MCPServers = make(map[string]any)
-		for k, v := range c.options.MCPServers {
-			transportOptions.MCPServers[k] = v
+	if len(c.options.SeedMessages) > 0 {
+		seeded, err := newSeededStream(c.options.SeedMessages, stream)
+		if err != nil {
+			return err
 		}
+		stream = seeded
 	}
-	trans := transport.NewSubprocessCLITransport(stream, transportOptions)
-	if err := trans.Connect(ctx); err != nil {
+
+	// Fail fast while the CLI keeps failing to start
+	if err := breaker.allow(); err != nil {
 		return err
 	}
 
+	c.timingsMu.Lock()
+	c.timings = Timings{ConnectStart: time.Now()}
+	c.timingsMu.Unlock()
+
+	trans := newTransport(stream, c.options.toTransportOptions())
+	err := trans.Connect(ctx)
+	breaker.record(err)
+	if err != nil {
+		return translateError(err)
+	}
+
+	// The subprocess transport knows when the process started
+	if spawned, ok := trans.(interface{ SpawnedAt() time.Time }); ok {
+		c.timingsMu.Lock()
+		c.timings.ProcessSpawned = spawned.SpawnedAt()
+		c.timingsMu.Unlock()
+	}
+
 	c.transport = trans
+	c.delivered.Store(0)
+	c.resetReady()
+	connected = true
 	return nil
 }
 
-// ReceiveMessages returns a channel that yields all messages from Claude
+// ReceiveMessages returns a channel that yields all messages from Claude.
+// Cancelling ctx stops receiving and closes the channel; output not yet
+// received stays with the transport for a later call.
 func (c *Client) ReceiveMessages(ctx context.Context) <-chan MessageResult {
+	return c.receive(ctx, false)
+}
+
+// receive starts the goroutine behind ReceiveMessages. With untilResponse
+// set it stops after the message that ends the response, so the next
+// response's output is left for a later call.
+func (c *Client) receive(ctx context.Context, untilResponse bool) <-chan MessageResult {
 	c.mu.Lock()
 	transport := c.transport
+	gen := c.readyGeneration()
 	c.mu.Unlock()
 
 	if transport == nil {
@@ -147,26 +244,336 @@ func (c *Client) ReceiveMessages(ctx context.Context) <-chan MessageResult {
 	go func() {
 		defer close(out)
 
-		msgChan := transport.ReceiveMessages(ctx)
-		for data := range msgChan {
-			if data.Err != nil {
-				out <- MessageResult{Error: data.Err}
-				return
+		// deliver hands result to the consumer, giving up once ctx is done
+		deliver := func(result MessageResult) bool {
+			select {
+			case out <- result:
+				return true
+			case <-ctx.Done():
+				return false
 			}
+		}
+		outputEnded := func() {
+			c.markReady(gen, NewCLIConnectionError("Output ended before the CLI was ready"))
+		}
 
-			msg, err := parseMessage(data.Data)
-			if err != nil {
-				out <- MessageResult{Error: err}
-				return
+		// Pings synthesized while the output is quiet, see Options.Heartbeat
+		var heartbeat <-chan time.Time
+		resetHeartbeat := func() {}
+		if interval := c.options.Heartbeat; interval > 0 {
+			timer := time.NewTimer(interval)
+			defer timer.Stop()
+			heartbeat = timer.C
+			resetHeartbeat = func() {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(interval)
 			}
+		}
+
+		msgChan := transport.ReceiveMessages(ctx)
+		for {
+			select {
+			case data, ok := <-msgChan:
+				if !ok {
+					outputEnded()
+					return
+				}
+				resetHeartbeat()
+
+				if err := c.waitIfPaused(ctx); err != nil {
+					deliver(MessageResult{Error: err})
+					return
+				}
+
+				// Replayed history always precedes live output
+				if !c.deliverReplay(ctx, out) {
+					return
+				}
+
+				if data.Err != nil {
+					outputEnded()
+					deliver(MessageResult{Error: translateError(data.Err)})
+					return
+				}
+
+				// Requests from the CLI are answered rather than delivered
+				if data.Data["type"] == "control_request" {
+					if err := c.handleControlRequest(ctx, transport, data.Data); err != nil {
+						deliver(MessageResult{Error: translateError(err)})
+						return
+					}
+					continue
+				}
+
+				// Guard against runaway sessions
+				if limit := c.options.MaxMessages; limit > 0 && c.delivered.Add(1) > int64(limit) {
+					_ = transport.Interrupt(ctx)
+					deliver(MessageResult{Error: ErrMessageLimit})
+					return
+				}
+
+				msg, err := parseMessage(data.Data)
+				if err != nil {
+					deliver(MessageResult{Error: err})
+					return
+				}
+
+				// The CLI's keepalives are only delivered with a heartbeat
+				if m, ok := msg.(*SystemMessage); ok && m.Subtype == "ping" && c.options.Heartbeat <= 0 {
+					continue
+				}
+
+				// Results the CLI didn't echo metadata on keep the client's
+				if result, ok := msg.(*ResultMessage); ok && result.Metadata == nil && len(c.options.Metadata) > 0 {
+					result.Metadata = make(map[string]string, len(c.options.Metadata))
+					for key, value := range c.options.Metadata {
+						result.Metadata[key] = value
+					}
+				}
+
+				// Guardrail: the matching message is withheld. ErrStopped is
+				// delivered without waiting for the CLI to acknowledge the
+				// interrupt, which outlives a ctx canceled once it arrives
+				if stop := c.options.StopPredicate; stop != nil && stop(msg) {
+					go func() {
+						_ = transport.Interrupt(context.WithoutCancel(ctx))
+					}()
+					deliver(MessageResult{Error: ErrStopped})
+					return
+				}
+
+				c.observe(gen, msg)
+				if !deliver(MessageResult{Message: msg}) {
+					return
+				}
 
-			out <- MessageResult{Message: msg}
+				if c.options.endsResponse(msg) && (untilResponse || c.stopAfterTurn.CompareAndSwap(true, false)) {
+					return
+				}
+
+			case <-c.replayReady:
+				if err := c.waitIfPaused(ctx); err != nil {
+					deliver(MessageResult{Error: err})
+					return
+				}
+				if !c.deliverReplay(ctx, out) {
+					return
+				}
+
+			case <-heartbeat:
+				if err := c.waitIfPaused(ctx); err != nil {
+					deliver(MessageResult{Error: err})
+					return
+				}
+				if !deliver(MessageResult{Message: &SystemMessage{Subtype: "ping", Data: map[string]any{"synthesized": true}}}) {
+					return
+				}
+				resetHeartbeat()
+
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	return out
 }
 
+// Replay queues historical messages, e.g. from a stored transcript, for
+// delivery through ReceiveMessages without sending anything to the CLI.
+// Replayed messages are delivered ahead of any live output not yet
+// delivered, and are marked with MessageResult.Replayed.
+//
+// This is useful when resuming a session so that handlers see the prior
+// conversation before new output arrives.
+func (c *Client) Replay(messages []Message) {
+	results := make([]MessageResult, 0, len(messages))
+	for _, msg := range messages {
+		results = append(results, MessageResult{Message: msg, Replayed: true})
+	}
+	c.enqueue(results)
+}
+
+// enqueue queues messages for delivery ahead of live output.
+func (c *Client) enqueue(results []MessageResult) {
+	c.replayMu.Lock()
+	c.replay = append(c.replay, results...)
+	c.replayMu.Unlock()
+
+	select {
+	case c.replayReady <- struct{}{}:
+	default:
+		// A delivery is already pending
+	}
+}
+
+// deliverReplay sends all queued messages to out. If ctx is done first,
+// the undelivered messages are queued again for the next consumer and it
+// returns false.
+func (c *Client) deliverReplay(ctx context.Context, out chan<- MessageResult) bool {
+	c.replayMu.Lock()
+	results := c.replay
+	c.replay = nil
+	c.replayMu.Unlock()
+
+	for i, result := range results {
+		select {
+		case out <- result:
+		case <-ctx.Done():
+			c.replayMu.Lock()
+			c.replay = append(results[i:len(results):len(results)], c.replay...)
+			c.replayMu.Unlock()
+			select {
+			case c.replayReady <- struct{}{}:
+			default:
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// send writes messages to the CLI and, with Options.EchoPrompts set, queues
+// them for delivery as UserMessages once written.
+func (c *Client) send(ctx context.Context, trans transport.Transport, messages []map[string]any, sessionID string) error {
+	if err := trans.SendRequest(ctx, messages, map[string]any{"session_id": sessionID}); err != nil {
+		return translateError(err)
+	}
+	if !c.options.EchoPrompts {
+		return nil
+	}
+
+	var echoes []MessageResult
+	for _, message := range messages {
+		// Messages that don't parse, e.g. custom envelopes, aren't echoed
+		if msg, err := parseMessage(message); err == nil {
+			echoes = append(echoes, MessageResult{Message: msg})
+		}
+	}
+	c.enqueue(echoes)
+	return nil
+}
+
+// observe records client state derived from a message received on the
+// connection of readiness generation gen.
+func (c *Client) observe(gen uint64, msg Message) {
+	c.recordTimings(msg)
+
+	if m, ok := msg.(*SystemMessage); ok && m.Subtype == "init" {
+		c.markReady(gen, nil)
+	}
+
+	if m, ok := msg.(*AssistantMessage); ok {
+		c.toolUseMu.Lock()
+		for _, block := range m.Content {
+			if toolUse, ok := block.(*ToolUseBlock); ok {
+				c.toolUseIDs = append(c.toolUseIDs, toolUse.ID)
+			}
+		}
+		c.toolUseMu.Unlock()
+	}
+
+	if m, ok := msg.(*ResultMessage); ok {
+		c.ctrlCPresses.Store(0)
+
+		c.cacheMu.Lock()
+		c.cacheStats.add(m.Usage)
+		c.cacheMu.Unlock()
+
+		c.turnMu.Lock()
+		callback := c.onTurnComplete
+		c.turnMu.Unlock()
+		if callback != nil {
+			callback(m)
+		}
+	}
+}
+
+// OnTurnComplete registers a callback invoked with every ResultMessage
+// received, i.e. at the end of each turn, before the message is delivered.
+// Unlike ReceiveResponse it does not stop after the first result. The
+// callback runs on the receiving goroutine and should return quickly.
+// Passing nil removes the callback.
+func (c *Client) OnTurnComplete(callback func(*ResultMessage)) {
+	c.turnMu.Lock()
+	defer c.turnMu.Unlock()
+	c.onTurnComplete = callback
+}
+
+// StopAfterTurn ends ReceiveMessages gracefully once the current turn
+// finishes: the next ResultMessage is delivered and the channel is closed
+// right after it, without interrupting the CLI. Output that follows stays
+// with the transport and is delivered by a later ReceiveMessages call.
+func (c *Client) StopAfterTurn() {
+	c.stopAfterTurn.Store(true)
+}
+
+// Pause stops delivering messages from ReceiveMessages until Resume is called.
+//
+// While paused, messages are not dropped: they stay in the transport's
+// buffered channel, and once that fills up the CLI's stdout pipe applies
+// backpressure to the subprocess. A long pause on a chatty session
+// therefore holds up to the channel capacity (plus the OS pipe buffer) in
+// memory and stalls the CLI until Resume is called.
+func (c *Client) Pause() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+}
+
+// Resume continues delivering messages after Pause, in the order they
+// were produced. It is a no-op if the client is not paused.
+func (c *Client) Resume() {
+	c.pauseMu.Lock()
+	defer c.pauseMu.Unlock()
+
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+// waitIfPaused blocks while the client is paused or until ctx is done.
+func (c *Client) waitIfPaused(ctx context.Context) error {
+	c.pauseMu.Lock()
+	resumed := c.resumed
+	c.pauseMu.Unlock()
+
+	if resumed == nil {
+		return nil
+	}
+
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsStreaming reports whether the connection runs in streaming mode.
+//
+// Connecting with a string prompt sends it with --print and closes stdin,
+// so Query and SendToolResult are unavailable and Interrupt falls back to
+// signalling the process. Connecting with nil or a MessageStream runs in
+// streaming mode, which those methods require. IsStreaming returns false
+// when not connected.
+func (c *Client) IsStreaming() bool {
+	c.mu.Lock()
+	transport := c.transport
+	c.mu.Unlock()
+
+	return transport != nil && transport.IsStreaming()
+}
+
 // Query sends a new request in streaming mode
 //
 // Parameters:
@@ -183,6 +590,9 @@ func (c *Client) Query(ctx context.Context, prompt any, sessionID string) error
 
 	switch p := prompt.(type) {
 	case string:
+		if err := c.options.checkPromptTokens(p); err != nil {
+			return err
+		}
 		message := map[string]any{
 			"type": "user",
 			"message": map[string]any{
@@ -192,7 +602,7 @@ func (c *Client) Query(ctx context.Context, prompt any, sessionID string) error
 			"parent_tool_use_id": nil,
 			"session_id":         sessionID,
 		}
-		return transport.SendRequest(ctx, []map[string]any{message}, map[string]any{"session_id": sessionID})
+		return c.send(ctx, transport, []map[string]any{message}, sessionID)
 
 	case MessageStream:
 		var messages []map[string]any
@@ -213,7 +623,7 @@ func (c *Client) Query(ctx context.Context, prompt any, sessionID string) error
 		}
 
 		if len(messages) > 0 {
-			return transport.SendRequest(ctx, messages, map[string]any{"session_id": sessionID})
+			return c.send(ctx, transport, messages, sessionID)
 		}
 		return nil
 
@@ -222,6 +632,110 @@ func (c *Client) Query(ctx context.Context, prompt any, sessionID string) error
 	}
 }
 
+// SendToolResult replies to a tool use with its result. The message's
+// parent_tool_use_id is set to toolUseID so the CLI links the reply to the
+// originating tool use. If toolUseID is empty, the most recent unanswered
+// tool use received from the assistant is used.
+//
+// Content may be a string or a slice of content block maps.
+func (c *Client) SendToolResult(ctx context.Context, toolUseID string, content any) error {
+	c.mu.Lock()
+	transport := c.transport
+	c.mu.Unlock()
+
+	if transport == nil {
+		return NewCLIConnectionError("Not connected. Call Connect() first.")
+	}
+
+	toolUseID, err := c.claimToolUse(toolUseID)
+	if err != nil {
+		return err
+	}
+
+	message := NewMessageBuilder("default").ToolResult(toolUseID, content)
+	return c.send(ctx, transport, []map[string]any{message}, "default")
+}
+
+// SendToolResultAndPrompt replies to a tool use and adds a follow-up
+// instruction in the same turn: the user message holds the tool_result
+// block followed by a text block with prompt. toolUseID and result are
+// handled as in SendToolResult.
+func (c *Client) SendToolResultAndPrompt(ctx context.Context, toolUseID string, result any, prompt string) error {
+	c.mu.Lock()
+	transport := c.transport
+	c.mu.Unlock()
+
+	if transport == nil {
+		return NewCLIConnectionError("Not connected. Call Connect() first.")
+	}
+
+	toolUseID, err := c.claimToolUse(toolUseID)
+	if err != nil {
+		return err
+	}
+
+	message := NewMessageBuilder("default").ToolResultAndText(toolUseID, result, prompt)
+	return c.send(ctx, transport, []map[string]any{message}, "default")
+}
+
+// claimToolUse resolves the tool use a reply answers, defaulting to the
+// most recent unanswered one, and marks it answered.
+func (c *Client) claimToolUse(toolUseID string) (string, error) {
+	c.toolUseMu.Lock()
+	defer c.toolUseMu.Unlock()
+
+	if toolUseID == "" {
+		if len(c.toolUseIDs) == 0 {
+			return "", &SDKError{message: "no pending tool use to reply to"}
+		}
+		toolUseID = c.toolUseIDs[len(c.toolUseIDs)-1]
+	}
+	for i, id := range c.toolUseIDs {
+		if id == toolUseID {
+			c.toolUseIDs = append(c.toolUseIDs[:i], c.toolUseIDs[i+1:]...)
+			break
+		}
+	}
+	return toolUseID, nil
+}
+
+// SlashCommand sends a CLI slash command, e.g. SlashCommand(ctx, "compact", "")
+// for /compact. Any system messages the command produces are delivered by
+// ReceiveMessages like other output.
+func (c *Client) SlashCommand(ctx context.Context, cmd string, args string) error {
+	c.mu.Lock()
+	transport := c.transport
+	c.mu.Unlock()
+
+	if transport == nil {
+		return NewCLIConnectionError("Not connected. Call Connect() first.")
+	}
+
+	name := strings.TrimPrefix(cmd, "/")
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return &SDKError{message: fmt.Sprintf("invalid slash command: %q", cmd)}
+	}
+
+	message := NewMessageBuilder("default").SlashCommand(name, args)
+	return c.send(ctx, transport, []map[string]any{message}, "default")
+}
+
+// CloseInput half-closes the connection: the CLI's stdin is closed once any
+// queued messages are written, telling it no more prompts will follow,
+// while ReceiveMessages keeps yielding its remaining output. Further calls
+// to Query fail after CloseInput.
+func (c *Client) CloseInput() error {
+	c.mu.Lock()
+	transport := c.transport
+	c.mu.Unlock()
+
+	if transport == nil {
+		return NewCLIConnectionError("Not connected. Call Connect() first.")
+	}
+
+	return translateError(transport.CloseInput())
+}
+
 // Interrupt sends an interrupt signal (only works with streaming mode)
 func (c *Client) Interrupt(ctx context.Context) error {
 	c.mu.Lock()
@@ -232,7 +746,7 @@ func (c *Client) Interrupt(ctx context.Context) error {
 		return NewCLIConnectionError("Not connected. Call Connect() first.")
 	}
 
-	return transport.Interrupt(ctx)
+	return translateError(transport.Interrupt(ctx))
 }
 
 // ReceiveResponse receives messages from Claude until and including a ResultMessage.
@@ -246,6 +760,8 @@ func (c *Client) Interrupt(ctx context.Context) error {
 // - Terminates immediately after yielding a ResultMessage
 // - The ResultMessage IS included in the yielded messages
 // - If no ResultMessage is received, the iterator continues indefinitely
+// - With Options.ResultStopSubtypes set, only results with one of those
+//   subtypes end the response; others are yielded and receiving continues
 //
 // Returns:
 //   - A channel that yields messages until a ResultMessage is received
@@ -272,35 +788,99 @@ func (c *Client) Interrupt(ctx context.Context) error {
 //	    }
 //	}
 func (c *Client) ReceiveResponse(ctx context.Context) <-chan MessageResult {
-	out := make(chan MessageResult)
-	messages := c.ReceiveMessages(ctx)
+	// Receiving stops right after the ResultMessage, so the next response
+	// is left for the next call
+	return c.receive(ctx, true)
+}
 
-	go func() {
-		defer close(out)
+// CollectResponse gathers the messages of the current response, up to and
+// including the ResultMessage.
+//
+// If ctx is done before the response completes, the messages gathered so
+// far are returned together with ctx's error, so partial output is not
+// lost. An error from the stream is returned the same way.
+func (c *Client) CollectResponse(ctx context.Context) ([]Message, error) {
+	// Stop the receiver if the response is abandoned, so it doesn't take
+	// the next response's messages
+	receiveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	messages := c.ReceiveResponse(receiveCtx)
+
+	var collected []Message
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return collected, nil
+			}
+			if msg.Error != nil {
+				return collected, msg.Error
+			}
+			collected = append(collected, msg.Message)
+		case <-ctx.Done():
+			return collected, ctx.Err()
+		}
+	}
+}
+
+// Ask sends a single prompt and waits for the complete response.
+//
+// It combines Query and ReceiveResponse: the prompt is sent on the
+// "default" session, and every content block from the assistant messages
+// of the turn is gathered into one AssistantMessage, returned alongside
+// the turn's ResultMessage.
+//
+// Example:
+//
+//	reply, result, err := client.Ask(ctx, "What's the capital of France?")
+//	if err != nil {
+//	    log.Fatal(err)
+//	}
+//	fmt.Println(len(reply.Content), result.NumTurns)
+func (c *Client) Ask(ctx context.Context, prompt string) (*AssistantMessage, *ResultMessage, error) {
+	if err := c.Query(ctx, prompt, "default"); err != nil {
+		return nil, nil, err
+	}
 
-		for msg := range messages {
-			out <- msg
+	// Stop the receiver if the response is abandoned, so it doesn't take
+	// the next response's messages
+	receiveCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	messages, err := collectMessages(c.ReceiveResponse(receiveCtx))
+	if err != nil {
+		return nil, nil, err
+	}
 
-			if msg.Error == nil {
-				if _, ok := msg.Message.(*ResultMessage); ok {
-					return // Terminate after ResultMessage
-				}
-			}
+	reply := &AssistantMessage{}
+	var result *ResultMessage
+	for _, msg := range messages {
+		switch m := msg.(type) {
+		case *AssistantMessage:
+			reply.Content = append(reply.Content, m.Content...)
+		case *ResultMessage:
+			result = m
 		}
-	}()
+	}
 
-	return out
+	if result == nil {
+		return reply, nil, &SDKError{message: "response ended without a result message"}
+	}
+
+	return reply, result, nil
 }
 
 // Disconnect closes the connection to Claude
 func (c *Client) Disconnect() error {
+	c.disableCtrlCInterrupt()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
 	if c.transport != nil {
 		err := c.transport.Disconnect()
 		c.transport = nil
-		return err
+		processes.release()
+		return translateError(err)
 	}
 	return nil
 }
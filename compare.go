@@ -0,0 +1,89 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Compare sends the same prompt to two independently configured queries
+// concurrently and returns both final results. It is intended for A/B
+// evaluation, e.g. running one prompt against two models.
+//
+// Each query runs over its own transport. If the ResultMessage does not
+// carry a result text, Result is populated from the assistant text blocks
+// received during that query.
+//
+// If one query fails, the other's result is still returned and err
+// describes the failing side. If both fail, err joins both errors.
+//
+// Example:
+//
+//	a := &Options{Model: "claude-sonnet-4-20250514"}
+//	b := &Options{Model: "claude-opus-4-20250514"}
+//	resultA, resultB, err := Compare(ctx, "Summarize RFC 2616", a, b)
+func Compare(ctx context.Context, prompt string, optsA, optsB *Options) (resultA, resultB *ResultMessage, err error) {
+	var errA, errB error
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		resultA, errA = queryResult(ctx, prompt, optsA)
+	}()
+	go func() {
+		defer wg.Done()
+		resultB, errB = queryResult(ctx, prompt, optsB)
+	}()
+	wg.Wait()
+
+	if errA != nil {
+		errA = fmt.Errorf("query A failed: %w", errA)
+	}
+	if errB != nil {
+		errB = fmt.Errorf("query B failed: %w", errB)
+	}
+
+	return resultA, resultB, errors.Join(errA, errB)
+}
+
+// queryResult runs a query to completion and returns its ResultMessage.
+func queryResult(ctx context.Context, prompt string, options *Options) (*ResultMessage, error) {
+	messages, err := Query(ctx, prompt, options)
+	if err != nil {
+		return nil, err
+	}
+
+	collected, err := collectMessages(messages)
+	if err != nil {
+		return nil, err
+	}
+
+	var text strings.Builder
+	var result *ResultMessage
+	for _, msg := range collected {
+		switch m := msg.(type) {
+		case *AssistantMessage:
+			for _, block := range m.Content {
+				if textBlock, ok := block.(*TextBlock); ok {
+					text.WriteString(textBlock.Text)
+				}
+			}
+		case *ResultMessage:
+			result = m
+		}
+	}
+
+	if result == nil {
+		return nil, &SDKError{message: "query completed without a result message"}
+	}
+
+	if result.Result == nil {
+		answer := text.String()
+		result.Result = &answer
+	}
+
+	return result, nil
+}
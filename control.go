@@ -0,0 +1,86 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/davlia/claude-code-sdk-go/internal/transport"
+)
+
+// Directions passed to Options.OnControl.
+const (
+	ControlSent     = transport.ControlSent     // written to the CLI
+	ControlReceived = transport.ControlReceived // read from the CLI
+)
+
+// controlRequester is implemented by transports that can send arbitrary
+// control requests, such as the subprocess transport in streaming mode.
+type controlRequester interface {
+	SendControlRequest(ctx context.Context, request map[string]any) (map[string]any, error)
+}
+
+// sendControlRequest sends a control request to the CLI and waits for its
+// acknowledgement.
+func (c *Client) sendControlRequest(ctx context.Context, request map[string]any) (map[string]any, error) {
+	c.mu.Lock()
+	trans := c.transport
+	c.mu.Unlock()
+
+	if trans == nil {
+		return nil, NewCLIConnectionError("Not connected. Call Connect() first.")
+	}
+	requester, ok := trans.(controlRequester)
+	if !ok || !trans.IsStreaming() {
+		return nil, NewCLIConnectionError(fmt.Sprintf("%v control requests require streaming mode", request["subtype"]))
+	}
+
+	response, err := requester.SendControlRequest(ctx, request)
+	return response, translateError(err)
+}
+
+// SetPermissionMode changes the permission mode of the running session,
+// e.g. to let a UI toggle accepting edits without reconnecting. It sends a
+// set_permission_mode control request and waits for the CLI to acknowledge
+// it, so it requires streaming mode.
+func (c *Client) SetPermissionMode(ctx context.Context, mode PermissionMode) error {
+	if mode == "" {
+		return &SDKError{message: "permission mode must not be empty"}
+	}
+	_, err := c.sendControlRequest(ctx, map[string]any{
+		"subtype": "set_permission_mode",
+		"mode":    string(mode),
+	})
+	return err
+}
+
+// InterruptSession interrupts the current turn of one session only, for
+// clients that multiplex several sessions over one CLI process, so one
+// user's turn can be stopped without affecting the others. It sends an
+// interrupt control request carrying the session ID and waits for the
+// acknowledgement, so it requires streaming mode. Use Interrupt to stop
+// every session.
+func (c *Client) InterruptSession(ctx context.Context, sessionID string) error {
+	if sessionID == "" {
+		return &SDKError{message: "session ID must not be empty"}
+	}
+	_, err := c.sendControlRequest(ctx, map[string]any{
+		"subtype":    "interrupt",
+		"session_id": sessionID,
+	})
+	return err
+}
+
+// QueryWithMode switches the session to the given permission mode and then
+// sends prompt, like Query. Options.PermissionMode only applies when the
+// CLI starts, so the switch is made with the control protocol's
+// set_permission_mode request and needs streaming mode; if the CLI rejects
+// the request, the error is returned and nothing is sent.
+//
+// The mode stays in effect for the rest of the session, including later
+// queries, until it is changed again.
+func (c *Client) QueryWithMode(ctx context.Context, prompt any, sessionID string, mode PermissionMode) error {
+	if err := c.SetPermissionMode(ctx, mode); err != nil {
+		return err
+	}
+	return c.Query(ctx, prompt, sessionID)
+}
@@ -0,0 +1,277 @@
+package claude
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Conversation accumulates the messages of a session along with its
+// session ID, completed turns and cost. It serializes to JSON, storing
+// messages in the CLI's stream-json shape, so a session can be persisted
+// and later resumed or replayed.
+//
+// Example:
+//
+//	conv := claude.NewConversation()
+//	for result := range client.ReceiveMessages(ctx) {
+//	    conv.Add(result.Message)
+//	}
+//	data, err := json.Marshal(conv)
+//
+//	// Later
+//	var conv claude.Conversation
+//	err = json.Unmarshal(data, &conv)
+//	client := claude.NewClient(conv.ResumeOptions(options))
+//	client.Replay(conv.Messages)
+type Conversation struct {
+	SessionID string
+	Messages  []Message
+	Turns     int     // completed turns, one per ResultMessage
+	CostUSD   float64 // total cost reported by result messages
+}
+
+// NewConversation creates an empty Conversation.
+func NewConversation() *Conversation {
+	return &Conversation{}
+}
+
+// Add appends a message, updating the session ID, turn count and cost from
+// init and result messages. Nil messages are ignored.
+func (c *Conversation) Add(msg Message) {
+	if msg == nil {
+		return
+	}
+	c.Messages = append(c.Messages, msg)
+
+	switch m := msg.(type) {
+	case *SystemMessage:
+		sessionID := m.SessionID
+		if sessionID == "" {
+			sessionID, _ = m.Data["session_id"].(string)
+		}
+		if sessionID != "" && m.Subtype == "init" {
+			c.SessionID = sessionID
+		}
+	case *ResultMessage:
+		c.Turns++
+		if m.TotalCostUSD != nil {
+			c.CostUSD += *m.TotalCostUSD
+		}
+		if m.SessionID != "" {
+			c.SessionID = m.SessionID
+		}
+	}
+}
+
+// ResumeOptions returns a copy of options, or of the defaults if nil, that
+// resumes the conversation's session.
+func (c *Conversation) ResumeOptions(options *Options) *Options {
+	if options == nil {
+		options = NewOptions()
+	}
+	resumed := options.Clone()
+	resumed.Resume = c.SessionID
+	resumed.ContinueConversation = false
+	return resumed
+}
+
+// conversationJSON is the serialized form of a Conversation.
+type conversationJSON struct {
+	SessionID string           `json:"session_id,omitempty"`
+	Turns     int              `json:"turns"`
+	CostUSD   float64          `json:"cost_usd"`
+	Messages  []map[string]any `json:"messages"`
+}
+
+// MarshalJSON encodes the conversation with its messages in stream-json
+// form.
+func (c Conversation) MarshalJSON() ([]byte, error) {
+	encoded := conversationJSON{
+		SessionID: c.SessionID,
+		Turns:     c.Turns,
+		CostUSD:   c.CostUSD,
+		Messages:  make([]map[string]any, 0, len(c.Messages)),
+	}
+	for _, msg := range c.Messages {
+		wire, err := messageToWire(msg)
+		if err != nil {
+			return nil, err
+		}
+		encoded.Messages = append(encoded.Messages, wire)
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes a conversation encoded by MarshalJSON.
+func (c *Conversation) UnmarshalJSON(data []byte) error {
+	var decoded conversationJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	messages := make([]Message, 0, len(decoded.Messages))
+	for i, wire := range decoded.Messages {
+		msg, err := parseMessage(wire)
+		if err != nil {
+			return fmt.Errorf("conversation message %d: %w", i, err)
+		}
+		messages = append(messages, msg)
+	}
+
+	*c = Conversation{
+		SessionID: decoded.SessionID,
+		Messages:  messages,
+		Turns:     decoded.Turns,
+		CostUSD:   decoded.CostUSD,
+	}
+	return nil
+}
+
+// messageToWire converts a message back to the stream-json shape the CLI
+// emits, which parseMessage accepts.
+func messageToWire(msg Message) (map[string]any, error) {
+	switch m := msg.(type) {
+	case *UserMessage:
+		var content any = m.Content
+		if m.Blocks != nil {
+			content = contentBlocksToWire(m.Blocks)
+		}
+		return map[string]any{
+			"type":    "user",
+			"message": map[string]any{"role": "user", "content": content},
+		}, nil
+
+	case *AssistantMessage:
+		message := map[string]any{
+			"role":    "assistant",
+			"content": contentBlocksToWire(m.Content),
+		}
+		if m.ID != "" {
+			message["id"] = m.ID
+		}
+		if m.Model != "" {
+			message["model"] = m.Model
+		}
+		if m.StopReason != "" {
+			message["stop_reason"] = m.StopReason
+		}
+		if m.StopSequence != "" {
+			message["stop_sequence"] = m.StopSequence
+		}
+		return map[string]any{"type": "assistant", "message": message}, nil
+
+	case *SystemMessage:
+		wire := map[string]any{"type": "system", "subtype": m.Subtype, "data": m.Data}
+		if m.SessionID != "" {
+			wire["session_id"] = m.SessionID
+		}
+		if m.WorkingDir != "" {
+			wire["cwd"] = m.WorkingDir
+		}
+		if m.Version != "" {
+			wire["claude_code_version"] = m.Version
+		}
+		return wire, nil
+
+	case *ResultMessage:
+		wire := map[string]any{
+			"type":            "result",
+			"subtype":         m.Subtype,
+			"duration_ms":     m.DurationMS,
+			"duration_api_ms": m.DurationAPIMS,
+			"is_error":        m.IsError,
+			"num_turns":       m.NumTurns,
+			"session_id":      m.SessionID,
+		}
+		if m.TotalCostUSD != nil {
+			wire["total_cost_usd"] = *m.TotalCostUSD
+		}
+		if m.Usage != nil {
+			wire["usage"] = m.Usage
+		}
+		if m.Result != nil {
+			wire["result"] = *m.Result
+		}
+		if m.StopReason != "" {
+			wire["stop_reason"] = m.StopReason
+		}
+		if m.ErrorType != "" || m.ErrorMessage != "" {
+			wire["error"] = map[string]any{"type": m.ErrorType, "message": m.ErrorMessage}
+		}
+		if m.ServiceTier != "" {
+			wire["service_tier"] = m.ServiceTier
+		}
+		if m.Metadata != nil {
+			wire["metadata"] = m.Metadata
+		}
+		if m.PermissionDenials != nil {
+			denials := make([]any, 0, len(m.PermissionDenials))
+			for _, denial := range m.PermissionDenials {
+				denials = append(denials, map[string]any{
+					"tool_name":   denial.ToolName,
+					"tool_use_id": denial.ToolUseID,
+					"tool_input":  denial.ToolInput,
+				})
+			}
+			wire["permission_denials"] = denials
+		}
+		return wire, nil
+
+	case *StreamEvent:
+		wire := map[string]any{
+			"type":       "stream_event",
+			"uuid":       m.UUID,
+			"session_id": m.SessionID,
+			"event":      m.Event,
+		}
+		if m.ParentToolUseID != "" {
+			wire["parent_tool_use_id"] = m.ParentToolUseID
+		}
+		return wire, nil
+
+	case *ToolProgress:
+		wire := map[string]any{
+			"type":                 "tool_progress",
+			"tool_use_id":          m.ToolUseID,
+			"tool_name":            m.ToolName,
+			"elapsed_time_seconds": m.ElapsedSeconds,
+		}
+		if m.ParentToolUseID != "" {
+			wire["parent_tool_use_id"] = m.ParentToolUseID
+		}
+		if m.SessionID != "" {
+			wire["session_id"] = m.SessionID
+		}
+		if m.Status != "" {
+			wire["status"] = m.Status
+		}
+		return wire, nil
+
+	default:
+		return nil, &SDKError{message: fmt.Sprintf("cannot serialize message of type %T", msg)}
+	}
+}
+
+// contentBlocksToWire converts content blocks to their stream-json shape.
+func contentBlocksToWire(blocks []ContentBlock) []any {
+	wire := make([]any, 0, len(blocks))
+	for _, block := range blocks {
+		switch b := block.(type) {
+		case *TextBlock:
+			wire = append(wire, map[string]any{"type": "text", "text": b.Text})
+		case *ToolUseBlock:
+			wire = append(wire, map[string]any{"type": "tool_use", "id": b.ID, "name": b.Name, "input": b.Input})
+		case *ImageBlock:
+			wire = append(wire, map[string]any{"type": "image", "source": b.Source})
+		case *DocumentBlock:
+			wire = append(wire, b.toWire())
+		case *ToolResultBlock:
+			result := b.toWire()
+			if b.Partial {
+				result["partial"] = true
+			}
+			wire = append(wire, result)
+		}
+	}
+	return wire
+}
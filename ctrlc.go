@@ -0,0 +1,73 @@
+package claude
+
+import (
+	"context"
+	"os"
+	"os/signal"
+)
+
+// EnableCtrlCInterrupt makes Ctrl-C in a terminal stop Claude rather than
+// the program: the first SIGINT interrupts the current response, and a
+// second one, before that response ends, disconnects the client.
+//
+// It is opt-in and meant for interactive terminal programs; while enabled,
+// SIGINT no longer terminates the process. The handler is removed, and the
+// prior SIGINT behavior restored, on Disconnect or when ctx is done. ctx is
+// also used for the interrupt requests. Calling it again while enabled has
+// no effect.
+//
+// Example:
+//
+//	client.EnableCtrlCInterrupt(ctx)
+//	defer client.Disconnect()
+func (c *Client) EnableCtrlCInterrupt(ctx context.Context) {
+	c.ctrlCMu.Lock()
+	defer c.ctrlCMu.Unlock()
+	if c.stopCtrlC != nil {
+		return
+	}
+	c.ctrlCPresses.Store(0)
+
+	sigCh := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigCh, os.Interrupt)
+	c.stopCtrlC = func() {
+		signal.Stop(sigCh)
+		close(done)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-sigCh:
+				c.handleCtrlC(ctx)
+			case <-ctx.Done():
+				c.disableCtrlCInterrupt()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// handleCtrlC responds to one SIGINT received with EnableCtrlCInterrupt.
+func (c *Client) handleCtrlC(ctx context.Context) {
+	if c.ctrlCPresses.Add(1) == 1 {
+		_ = c.Interrupt(ctx)
+		return
+	}
+	_ = c.Disconnect()
+}
+
+// disableCtrlCInterrupt removes the SIGINT handler, if any.
+func (c *Client) disableCtrlCInterrupt() {
+	c.ctrlCMu.Lock()
+	stop := c.stopCtrlC
+	c.stopCtrlC = nil
+	c.ctrlCMu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+}
@@ -1,18 +1,36 @@
 package claude
 
 import (
+	"errors"
 	"fmt"
+	"time"
+
+	"github.com/davlia/claude-code-sdk-go/internal/transport"
 )
 
 // SDKError is the base error type for all Claude SDK errors.
 type SDKError struct {
 	message string
+	cause   error // original error, for errors translated from the transport
 }
 
 func (e *SDKError) Error() string {
 	return e.message
 }
 
+// Unwrap returns the error this one was translated from, if any.
+func (e *SDKError) Unwrap() error {
+	return e.cause
+}
+
+// ErrMessageLimit is returned through ReceiveMessages when more than
+// Options.MaxMessages messages would be delivered.
+var ErrMessageLimit = &SDKError{message: "message limit reached"}
+
+// ErrStopped is returned through ReceiveMessages when Options.StopPredicate
+// matches a message.
+var ErrStopped = &SDKError{message: "stopped by stop predicate"}
+
 // CLIConnectionError is returned when unable to connect to Claude Code.
 type CLIConnectionError struct {
 	SDKError
@@ -88,6 +106,59 @@ func NewCLIJSONDecodeError(line string, originalError error) error {
 	}
 }
 
+// MessageTooLargeError is returned when a message from the CLI exceeds the
+// output buffer limit. The message is dropped.
+type MessageTooLargeError struct {
+	SDKError
+	Limit int // buffer limit in bytes
+	Size  int // bytes buffered when the limit was exceeded
+}
+
+// NewMessageTooLargeError creates a new MessageTooLargeError.
+func NewMessageTooLargeError(limit int, size int) error {
+	return &MessageTooLargeError{
+		SDKError: SDKError{
+			message: fmt.Sprintf("Message of at least %d bytes exceeded maximum buffer size of %d bytes", size, limit),
+		},
+		Limit: limit,
+		Size:  size,
+	}
+}
+
+// StartupTimeoutError is returned when the CLI produces no output within
+// Options.FirstMessageTimeout of starting, or when streaming of being sent
+// its first message, e.g. because it is waiting for an interactive login.
+// The process is killed.
+type StartupTimeoutError struct {
+	SDKError
+	Timeout time.Duration
+}
+
+// NewStartupTimeoutError creates a new StartupTimeoutError.
+func NewStartupTimeoutError(timeout time.Duration) error {
+	return &StartupTimeoutError{
+		SDKError: SDKError{message: fmt.Sprintf("No output from Claude Code within %v of starting", timeout)},
+		Timeout:  timeout,
+	}
+}
+
+// PromptTooLongError is returned when a prompt's estimated token count
+// exceeds Options.MaxPromptTokens. The prompt is not sent.
+type PromptTooLongError struct {
+	SDKError
+	Estimated int // estimated prompt tokens, see EstimateTokens
+	Limit     int
+}
+
+// NewPromptTooLongError creates a new PromptTooLongError.
+func NewPromptTooLongError(estimated int, limit int) error {
+	return &PromptTooLongError{
+		SDKError:  SDKError{message: fmt.Sprintf("Prompt of about %d tokens exceeds the limit of %d", estimated, limit)},
+		Estimated: estimated,
+		Limit:     limit,
+	}
+}
+
 // MessageParseError is returned when unable to parse a message from CLI output.
 type MessageParseError struct {
 	SDKError
@@ -101,3 +172,40 @@ func NewMessageParseError(message string, data map[string]interface{}) error {
 		Data:     data,
 	}
 }
+
+// translateError converts an error from the internal transport package, or
+// one wrapping it, to its public counterpart so callers can match it with
+// errors.As. The message is kept and the original error stays reachable
+// through errors.Unwrap. Other errors are returned unchanged.
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	base := SDKError{message: err.Error(), cause: err}
+
+	var notFound *transport.CLINotFoundError
+	var connection *transport.CLIConnectionError
+	var process *transport.ProcessError
+	var decode *transport.CLIJSONDecodeError
+	var tooLarge *transport.MessageTooLargeError
+	var startup *transport.StartupTimeoutError
+	var other *transport.TransportError
+	switch {
+	case errors.As(err, &notFound):
+		return &CLINotFoundError{CLIConnectionError: CLIConnectionError{SDKError: base}, CLIPath: notFound.CLIPath}
+	case errors.As(err, &connection):
+		return &CLIConnectionError{SDKError: base}
+	case errors.As(err, &process):
+		return &ProcessError{SDKError: base, ExitCode: process.ExitCode, Stderr: process.Stderr}
+	case errors.As(err, &decode):
+		return &CLIJSONDecodeError{SDKError: base, Line: decode.Line, OriginalError: decode.OriginalError}
+	case errors.As(err, &tooLarge):
+		return &MessageTooLargeError{SDKError: base, Limit: tooLarge.Limit, Size: tooLarge.Size}
+	case errors.As(err, &startup):
+		return &StartupTimeoutError{SDKError: base, Timeout: startup.Timeout}
+	case errors.As(err, &other):
+		return &base
+	default:
+		return err
+	}
+}
@@ -0,0 +1,33 @@
+package transport
+
+import "time"
+
+// clock is the source of time for the transport's timeouts and polling.
+// It is real time outside of tests, which replace it to trigger timeouts
+// without waiting for them.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) ticker
+}
+
+// ticker delivers ticks on C until stopped, like time.Ticker.
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is a clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) NewTicker(d time.Duration) ticker       { return realTicker{time.NewTicker(d)} }
+
+// realTicker adapts a time.Ticker to the ticker interface.
+type realTicker struct {
+	ticker *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time { return r.ticker.C }
+func (r realTicker) Stop()               { r.ticker.Stop() }
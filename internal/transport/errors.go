@@ -2,6 +2,7 @@ package transport
 
 import (
 	"fmt"
+	"time"
 )
 
 // TransportError is the base error type for transport errors.
@@ -86,4 +87,41 @@ func NewCLIJSONDecodeError(line string, originalError error) error {
 		Line:           line,
 		OriginalError:  originalError,
 	}
+}
+
+// MessageTooLargeError is returned when a message from the CLI exceeds the
+// output buffer limit. The message is dropped.
+type MessageTooLargeError struct {
+	TransportError
+	Limit int // buffer limit in bytes
+	Size  int // bytes buffered when the limit was exceeded
+}
+
+// NewMessageTooLargeError creates a new MessageTooLargeError.
+func NewMessageTooLargeError(limit int, size int) error {
+	return &MessageTooLargeError{
+		TransportError: TransportError{
+			message: fmt.Sprintf("Message of at least %d bytes exceeded maximum buffer size of %d bytes", size, limit),
+		},
+		Limit: limit,
+		Size:  size,
+	}
+}
+
+// StartupTimeoutError is returned when the CLI produces no output within
+// Options.FirstMessageTimeout of starting, or in streaming mode of being
+// sent its first message. The process is killed.
+type StartupTimeoutError struct {
+	TransportError
+	Timeout time.Duration
+}
+
+// NewStartupTimeoutError creates a new StartupTimeoutError.
+func NewStartupTimeoutError(timeout time.Duration) error {
+	return &StartupTimeoutError{
+		TransportError: TransportError{
+			message: fmt.Sprintf("No output from Claude Code within %v of starting", timeout),
+		},
+		Timeout: timeout,
+	}
 }
\ No newline at end of file
@@ -0,0 +1,13 @@
+package transport
+
+// Clock and Ticker expose the transport's clock to the external tests.
+type (
+	Clock  = clock
+	Ticker = ticker
+)
+
+// SetClock replaces the clock used for the transport's timeouts.
+func (t *SubprocessCLITransport) SetClock(c Clock) *SubprocessCLITransport {
+	t.clock = c
+	return t
+}
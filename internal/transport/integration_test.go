@@ -16,10 +16,10 @@ func TestIntegration_FullConversation(t *testing.T) {
 	defer cancel()
 
 	// Setup options with various configurations
-	options := claude.NewOptions()
+	options := transport.NewOptions()
 	options.SystemPrompt = "You are a helpful math tutor"
 	options.Model = "claude-3-sonnet"
-	options.PermissionMode = claude.PermissionModeDefault
+	options.PermissionMode = string(claude.PermissionModeDefault)
 	
 	// Create an interactive stream
 	prompt := claude.NewEmptyStream()
@@ -0,0 +1,41 @@
+//go:build linux
+
+package transport
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// applyResourceLimits sets the limits on the started process with
+// prlimit(2). Processes it starts afterwards, such as Bash tool commands,
+// inherit them.
+func applyResourceLimits(pid int, limits *ResourceLimits) error {
+	if limits == nil {
+		return nil
+	}
+	if limits.MaxMemoryBytes > 0 {
+		kib := max(limits.MaxMemoryBytes/1024, 1)
+		if err := prlimit(pid, syscall.RLIMIT_AS, kib*1024); err != nil {
+			return err
+		}
+	}
+	if limits.MaxCPUTime > 0 {
+		seconds := (limits.MaxCPUTime + time.Second - 1) / time.Second
+		if err := prlimit(pid, syscall.RLIMIT_CPU, uint64(seconds)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prlimit sets both the soft and hard limit of resource for pid.
+func prlimit(pid int, resource int, value uint64) error {
+	limit := syscall.Rlimit{Cur: value, Max: value}
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
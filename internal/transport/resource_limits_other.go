@@ -0,0 +1,9 @@
+//go:build !linux
+
+package transport
+
+// applyResourceLimits does nothing: resource limits are only supported on
+// Linux.
+func applyResourceLimits(pid int, limits *ResourceLimits) error {
+	return nil
+}
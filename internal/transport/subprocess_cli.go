@@ -2,14 +2,19 @@ package transport
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -22,22 +27,59 @@ const (
 	maxStderrSize  = 10 * 1024 * 1024 // 10MB stderr limit
 	stderrTimeout  = 30 * time.Second
 	disconnectTimeout = 5 * time.Second
+	controlRetryInterval = 250 * time.Millisecond
+	flagCheckWindow   = 2 * time.Second
+	defaultMaxPendingControl = 256
+	defaultControlTimeout = 10 * time.Second
+	maxInlineSystemPrompt = 100 * 1024 // longer system prompts are passed in a temp file
 )
 
+// OutputBufferSize is the number of messages buffered between the CLI's
+// stdout and the receiver.
+const OutputBufferSize = 100
+
+// Directions passed to Options.OnControl.
+const (
+	ControlSent     byte = '>' // written to the CLI's stdin
+	ControlReceived byte = '<' // read from the CLI's stdout
+)
+
+// unknownFlagPattern matches the CLI's usage error for an unrecognized flag.
+var unknownFlagPattern = regexp.MustCompile(`unknown option '(--[\w-]+)'`)
+
+// adjustableFlags are flags the transport can run without when the CLI
+// rejects them with Options.AutoAdjustFlags set.
+var adjustableFlags = map[string]bool{"--verbose": true}
+
+// checkedFlags holds, per CLI path, the adjustable flags found to be
+// rejected by that CLI, so only the first Connect has to check.
+var checkedFlags = struct {
+	sync.Mutex
+	dropped map[string]map[string]bool
+}{dropped: make(map[string]map[string]bool)}
+
 // SubprocessCLITransport implements Transport interface using subprocess.
 type SubprocessCLITransport struct {
 	prompt               MessageStream
 	options              *Options
 	cliPath              string
 	closeStdinAfterPrompt bool
+	droppedFlags         map[string]bool // flags the CLI rejected, see checkFlags
 	
 	// Process management
 	cmd           *exec.Cmd
 	stdin         io.WriteCloser
 	stdout        io.ReadCloser
 	stderr        io.ReadCloser
-	stdinChan     chan []byte
+	stdoutReader  io.Reader     // stdout, buffered if checkFlags peeked at it
+	stdoutPeeked  chan struct{} // closed once checkFlags stops peeking, if it did
+	stderrReader  io.Reader     // stderr, prefixed with anything checkFlags read
+	stderrRead    chan struct{} // closed once checkFlags stops reading, if it did
+	stdinChan     chan stdinWrite
+	stdinDone     chan struct{} // closed once handleStdin stops writing
 	outChan       chan MessageData
+	outClosed     bool        // outChan has been closed; it is kept for ReceiveMessages
+	backpressured atomic.Bool // outChan is above Options.BufferHighWaterMark
 	
 	// Control request handling
 	pendingControlResponses map[string]map[string]any
@@ -46,11 +88,32 @@ type SubprocessCLITransport struct {
 	// Connection state
 	mu            sync.RWMutex
 	connected     bool
+	connecting    bool // Connect is waiting in checkFlags without the lock
+	inputClosed   bool
+	exited        atomic.Bool
+	processDone   chan struct{} // closed once the process has been waited on
+	spawnedAt     time.Time     // when the process was started
+	firstOutput   chan struct{} // closed on the first stdout line, if FirstMessageTimeout is set
+	firstInput    chan struct{} // closed on the first stdin write, if streaming with FirstMessageTimeout set
+	
+	// First stdin write failure; once set the transport can't send
+	stdinErrMu    sync.Mutex
+	stdinErr      error
 	isStreaming   bool
 	sessionID     string
 	taskGroup     sync.WaitGroup
+	pipesRead     sync.WaitGroup // stdout and stderr read to the end
 	ctx           context.Context
 	cancel        context.CancelFunc
+	clock         clock // source of time for timeouts, replaced in tests
+	tempFiles     []string // created for this connection, removed on Disconnect
+}
+
+// stdinWrite is a message queued for handleStdin. Nil data closes stdin.
+type stdinWrite struct {
+	ctx  context.Context
+	data []byte
+	done chan error // receives the outcome of the write
 }
 
 // MessageData wraps message data or error.
@@ -63,14 +126,16 @@ type MessageData struct {
 func (t *SubprocessCLITransport) safeSend(msg MessageData) bool {
 	t.mu.RLock()
 	outChan := t.outChan
+	closed := t.outClosed
 	t.mu.RUnlock()
 	
-	if outChan == nil {
+	if outChan == nil || closed {
 		return false
 	}
 	
 	select {
 	case outChan <- msg:
+		t.checkBackpressure(len(outChan))
 		return true
 	case <-t.ctx.Done():
 		return false
@@ -78,6 +143,7 @@ func (t *SubprocessCLITransport) safeSend(msg MessageData) bool {
 		// Channel might be full, try with context
 		select {
 		case outChan <- msg:
+			t.checkBackpressure(len(outChan))
 			return true
 		case <-t.ctx.Done():
 			return false
@@ -85,6 +151,22 @@ func (t *SubprocessCLITransport) safeSend(msg MessageData) bool {
 	}
 }
 
+// checkBackpressure calls Options.OnBackpressure when the number of
+// buffered messages rises above Options.BufferHighWaterMark. It fires once
+// per crossing, and again only after the buffer has drained to the mark.
+func (t *SubprocessCLITransport) checkBackpressure(pending int) {
+	if t.options.OnBackpressure == nil || t.options.BufferHighWaterMark <= 0 {
+		return
+	}
+	if pending <= t.options.BufferHighWaterMark {
+		t.backpressured.Store(false)
+		return
+	}
+	if t.backpressured.CompareAndSwap(false, true) {
+		t.options.OnBackpressure(pending)
+	}
+}
+
 // NewSubprocessCLITransport creates a new subprocess CLI transport.
 func NewSubprocessCLITransport(prompt MessageStream, options *Options) *SubprocessCLITransport {
 	if options == nil {
@@ -100,6 +182,7 @@ func NewSubprocessCLITransport(prompt MessageStream, options *Options) *Subproce
 		sessionID:               "default",
 		isStreaming:             isStreaming,
 		pendingControlResponses: make(map[string]map[string]any),
+		clock:                   realClock{},
 	}
 }
 
@@ -132,74 +215,94 @@ func (t *SubprocessCLITransport) Connect(ctx context.Context) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	if t.connected {
+	if t.connected || t.connecting {
 		return NewCLIConnectionError("Already connected")
 	}
 
-	// Find CLI if not specified
+	// Find CLI if not specified, with the caller's locator if given
 	if t.cliPath == "" {
-		cliPath, err := t.findCLI()
+		locate := FindCLI
+		if t.options.CLILocator != nil {
+			locate = t.options.CLILocator
+		}
+		cliPath, err := locate()
 		if err != nil {
 			return err
 		}
 		t.cliPath = cliPath
 	}
 
-	// Create context for this connection
-	t.ctx, t.cancel = context.WithCancel(ctx)
-
-	// Build command
-	args := t.buildCommand()
-	t.cmd = exec.CommandContext(t.ctx, t.cliPath, args...)
-
-	// Set environment
-	env := os.Environ()
-	env = append(env, "CLAUDE_CODE_ENTRYPOINT=sdk-go")
-	t.cmd.Env = env
+	t.connecting = true
+	defer func() {
+		t.connecting = false
+	}()
 
-	// Set working directory if specified
-	if t.options.Cwd != "" {
-		t.cmd.Dir = t.options.Cwd
+	// Only the first Connect for a CLI path checks which flags it rejects
+	checkFlags := false
+	if t.options.AutoAdjustFlags {
+		checkedFlags.Lock()
+		dropped, checked := checkedFlags.dropped[t.cliPath]
+		checkedFlags.Unlock()
+		t.droppedFlags = dropped
+		checkFlags = !checked
 	}
 
-	// Setup pipes
-	var err error
-	t.stdin, err = t.cmd.StdinPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stdin pipe: %w", err)
-	}
+	// Create context for this connection
+	t.ctx, t.cancel = context.WithCancel(ctx)
 
-	t.stdout, err = t.cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %w", err)
-	}
+	// Temp files are removed if the process fails to start
+	defer func() {
+		if !t.connected {
+			t.removeTempFiles()
+		}
+	}()
 
-	t.stderr, err = t.cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %w", err)
-	}
+	// The prompt can only be read once, so it is kept for a respawn
+	promptArgs := t.promptArgs()
+	for {
+		if err := t.startProcess(promptArgs); err != nil {
+			return err
+		}
+		if !checkFlags {
+			break
+		}
 
-	// Start the process
-	if err := t.cmd.Start(); err != nil {
-		// Check if error is due to working directory
-		if t.options.Cwd != "" {
-			if _, statErr := os.Stat(t.options.Cwd); os.IsNotExist(statErr) {
-				return NewCLIConnectionError(fmt.Sprintf("Working directory does not exist: %s", t.options.Cwd))
+		rejected, settled := t.checkFlags()
+		if rejected == "" {
+			if settled {
+				checkedFlags.Lock()
+				checkedFlags.dropped[t.cliPath] = t.droppedFlags
+				checkedFlags.Unlock()
 			}
+			break
 		}
-		// Check if error is due to CLI not found
-		if _, statErr := os.Stat(t.cliPath); os.IsNotExist(statErr) {
-			return NewCLINotFoundError(fmt.Sprintf("Claude Code not found at: %s", t.cliPath), t.cliPath)
+
+		// Start again without the flag
+		dropped := map[string]bool{rejected: true}
+		for flag := range t.droppedFlags {
+			dropped[flag] = true
 		}
-		return NewProcessError("Failed to start Claude Code", 0, err.Error())
+		t.droppedFlags = dropped
+		t.removeTempFiles()
 	}
 
 	t.connected = true
-	t.outChan = make(chan MessageData, 100)
+	t.outChan = make(chan MessageData, OutputBufferSize)
+	t.outClosed = false
+	t.processDone = make(chan struct{})
+	t.firstOutput, t.firstInput = nil, nil
+	if t.options.FirstMessageTimeout > 0 {
+		t.firstOutput = make(chan struct{})
+		// A streaming CLI writes nothing until it has been sent something
+		if t.isStreaming {
+			t.firstInput = make(chan struct{})
+		}
+	}
 
 	// Handle stdin based on mode
 	if t.isStreaming {
-		t.stdinChan = make(chan []byte, 100)
+		t.stdinChan = make(chan stdinWrite, 100)
+		t.stdinDone = make(chan struct{})
 		t.taskGroup.Add(1)
 		go t.handleStdin()
 		
@@ -212,7 +315,14 @@ func (t *SubprocessCLITransport) Connect(ctx context.Context) error {
 		t.stdin = nil
 	}
 
+	// Watch for a CLI that starts but never writes anything
+	if timeout := t.options.FirstMessageTimeout; timeout > 0 {
+		t.taskGroup.Add(1)
+		go t.watchFirstOutput(timeout)
+	}
+
 	// Start reading stdout
+	t.pipesRead.Add(2)
 	t.taskGroup.Add(1)
 	go t.readOutput()
 
@@ -222,19 +332,29 @@ func (t *SubprocessCLITransport) Connect(ctx context.Context) error {
 
 	// Start a goroutine to coordinate process exit and channel closing
 	go func() {
-		// Wait for process to exit
+		// Wait closes the pipes, so it must not run before they have been
+		// read to the end
+		t.pipesRead.Wait()
+
+		// Wait for process to exit. This is the only call to cmd.Wait;
+		// Disconnect waits for processDone instead, since calling Wait
+		// twice on the same Cmd is not allowed
 		if t.cmd != nil {
 			t.cmd.Wait()
 		}
+		t.exited.Store(true)
+		close(t.processDone)
 		
 		// Wait for all reading goroutines to finish
 		t.taskGroup.Wait()
 		
 		// Close the output channel after everything is done
 		t.mu.Lock()
-		if t.outChan != nil {
+		// The closed channel is kept, so a late ReceiveMessages still
+		// returns a channel that ends rather than a nil one
+		if t.outChan != nil && !t.outClosed {
 			close(t.outChan)
-			t.outChan = nil
+			t.outClosed = true
 		}
 		t.mu.Unlock()
 	}()
@@ -245,9 +365,9 @@ func (t *SubprocessCLITransport) Connect(ctx context.Context) error {
 // Disconnect terminates the subprocess.
 func (t *SubprocessCLITransport) Disconnect() error {
 	t.mu.Lock()
-	defer t.mu.Unlock()
 
 	if !t.connected {
+		t.mu.Unlock()
 		return nil
 	}
 
@@ -268,36 +388,41 @@ func (t *SubprocessCLITransport) Disconnect() error {
 		t.stdin.Close()
 	}
 
-	// Wait for process to exit or force kill after timeout
-	done := make(chan error, 1)
-	go func() {
-		if t.cmd != nil {
-			done <- t.cmd.Wait()
-		} else {
-			done <- nil
-		}
-	}()
+	// The readers need the lock to deliver their last messages, so it is
+	// released before waiting for them
+	t.mu.Unlock()
 
+	// Wait for the coordinator goroutine started by Connect, the only
+	// caller of cmd.Wait, to reap the process, or force kill after timeout
 	select {
-	case <-done:
+	case <-t.processDone:
 		// Process exited normally
-	case <-time.After(disconnectTimeout):
+	case <-t.clock.After(disconnectTimeout):
 		// Force kill if timeout
 		if t.cmd != nil && t.cmd.Process != nil {
 			_ = t.cmd.Process.Kill()
-			<-done
 		}
+		// A child that inherited the pipes can hold them open after the
+		// CLI is gone; closing our ends lets the readers, and so Wait, finish
+		t.stdout.Close()
+		t.stderr.Close()
+		<-t.processDone
 	}
 
 	// Wait for all goroutines to finish
 	// This includes the goroutine that closes outChan
 	t.taskGroup.Wait()
 
+	t.removeTempFiles()
+
 	return nil
 }
 
 // ReceiveMessages returns a channel that yields messages.
 func (t *SubprocessCLITransport) ReceiveMessages(ctx context.Context) <-chan MessageData {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
 	return t.outChan
 }
 
@@ -309,17 +434,27 @@ func (t *SubprocessCLITransport) SendRequest(ctx context.Context, messages []map
 
 	t.mu.RLock()
 	connected := t.connected
+	inputClosed := t.inputClosed
 	t.mu.RUnlock()
 
 	if !connected {
 		return NewCLIConnectionError("Not connected")
 	}
+	if inputClosed {
+		return NewCLIConnectionError("Input already closed")
+	}
+	if err := t.stdinError(); err != nil {
+		return err
+	}
 
 	sessionID := "default"
 	if sid, ok := metadata["session_id"].(string); ok {
 		sessionID = sid
 	}
 
+	// Encode every message first and queue them as a single write, so
+	// concurrent requests can't interleave their messages
+	var batch []byte
 	for _, msg := range messages {
 		// Ensure message has required structure
 		if _, hasType := msg["type"]; !hasType {
@@ -334,18 +469,51 @@ func (t *SubprocessCLITransport) SendRequest(ctx context.Context, messages []map
 			}
 		}
 
-		data, err := json.Marshal(msg)
+		data, err := t.marshalMessage(t.withMetadata(msg))
 		if err != nil {
 			return fmt.Errorf("failed to marshal message: %w", err)
 		}
+		batch = append(append(batch, data...), '\n')
+	}
 
-		select {
-		case t.stdinChan <- append(data, '\n'):
-		case <-ctx.Done():
-			return ctx.Err()
+	if len(batch) == 0 {
+		return nil
+	}
+	if err := t.writeStdin(ctx, batch); err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if msg["type"] == "control_response" {
+			t.observeControl(ControlSent, msg)
 		}
 	}
+	return nil
+}
+
+// CloseInput closes the subprocess stdin once all queued messages have been
+// written, signalling that no more input will follow. Output can still be
+// received until the process exits. It is a no-op if input is already
+// closed or the transport is not streaming.
+func (t *SubprocessCLITransport) CloseInput() error {
+	t.mu.Lock()
+	if !t.connected {
+		t.mu.Unlock()
+		return NewCLIConnectionError("Not connected")
+	}
+	if t.inputClosed || !t.isStreaming {
+		t.mu.Unlock()
+		return nil
+	}
+	t.inputClosed = true
+	t.mu.Unlock()
 
+	// A nil entry tells handleStdin to close stdin after everything
+	// queued ahead of it has been written
+	select {
+	case t.stdinChan <- stdinWrite{}:
+	case <-t.stdinDone:
+	case <-t.ctx.Done():
+	}
 	return nil
 }
 
@@ -364,69 +532,234 @@ func (t *SubprocessCLITransport) Interrupt(ctx context.Context) error {
 		return cmd.Process.Signal(syscall.SIGINT)
 	}
 
-	// For streaming mode, send control request
+	// For streaming mode, send control request, resending it with the same
+	// request ID if no ack arrives in case the first one was lost
 	request := map[string]any{"subtype": "interrupt"}
-	_, err := t.sendControlRequest(ctx, request)
+	_, err := t.sendControlRequestWithRetries(ctx, request, t.options.InterruptRetries)
 	return err
 }
 
-// IsConnected checks if subprocess is running.
+// SendControlRequest sends a control request, such as
+// {"subtype": "set_permission_mode", "mode": "acceptEdits"}, and returns the
+// CLI's response once acknowledged. It only works in streaming mode.
+func (t *SubprocessCLITransport) SendControlRequest(ctx context.Context, request map[string]any) (map[string]any, error) {
+	if !t.isStreaming {
+		return nil, NewCLIConnectionError("Control requests only work in streaming mode")
+	}
+	return t.sendControlRequest(ctx, request)
+}
+
+// IsConnected checks if subprocess is running. It reports false once the
+// process has exited, even if Disconnect has not been called.
 func (t *SubprocessCLITransport) IsConnected() bool {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 	
-	return t.connected && t.cmd != nil && t.cmd.Process != nil
+	return t.connected && t.cmd != nil && t.cmd.Process != nil && !t.exited.Load()
 }
 
-// buildCommand builds CLI command with arguments.
-func (t *SubprocessCLITransport) buildCommand() []string {
-	cmd := []string{"--output-format", "stream-json", "--verbose"}
+// IsStreaming reports whether the transport runs in streaming mode, which
+// SendRequest and control requests require.
+func (t *SubprocessCLITransport) IsStreaming() bool {
+	return t.isStreaming
+}
 
-	if t.options.SystemPrompt != "" {
-		cmd = append(cmd, "--system-prompt", t.options.SystemPrompt)
+// SpawnedAt returns when the CLI process was started, or the zero time
+// before Connect succeeds.
+func (t *SubprocessCLITransport) SpawnedAt() time.Time {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.spawnedAt
+}
+
+// PID returns the process ID of the CLI and true while it is running, or
+// false before Connect, after Disconnect and once the process has exited.
+func (t *SubprocessCLITransport) PID() (int, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if !t.connected || t.cmd == nil || t.cmd.Process == nil || t.exited.Load() {
+		return 0, false
+	}
+	return t.cmd.Process.Pid, true
+}
+
+// buildEnv returns the subprocess environment: the parent environment unless
+// CleanEnv is set, followed by Env in key order, settings passed through the
+// environment and the SDK entrypoint.
+func (t *SubprocessCLITransport) buildEnv() []string {
+	var env []string
+	if !t.options.CleanEnv {
+		env = os.Environ()
+	}
+
+	keys := make([]string, 0, len(t.options.Env))
+	for key := range t.options.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		env = append(env, key+"="+t.options.Env[key])
+	}
+
+	if t.options.MaxTokens != nil {
+		env = append(env, fmt.Sprintf("CLAUDE_CODE_MAX_OUTPUT_TOKENS=%d", *t.options.MaxTokens))
+	}
+
+	return append(env, "CLAUDE_CODE_ENTRYPOINT=sdk-go")
+}
+
+// startProcess starts the CLI with the transport's flags, less any
+// dropped ones, followed by promptArgs. Arguments too large for the command
+// line are spilled to temp files.
+func (t *SubprocessCLITransport) startProcess(promptArgs []string) error {
+	args, err := t.spillSystemPrompt(t.buildCommand(promptArgs))
+	if err != nil {
+		return err
+	}
+
+	t.cmd = exec.CommandContext(t.ctx, t.cliPath, args...)
+
+	// Set environment
+	t.cmd.Env = t.buildEnv()
+
+	// Set working directory if specified
+	if t.options.Cwd != "" {
+		t.cmd.Dir = t.options.Cwd
 	}
 
-	if t.options.AppendSystemPrompt != "" {
-		cmd = append(cmd, "--append-system-prompt", t.options.AppendSystemPrompt)
+	// Setup pipes
+	t.stdin, err = t.cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdin pipe: %w", err)
 	}
 
-	if len(t.options.AllowedTools) > 0 {
-		cmd = append(cmd, "--allowedTools", strings.Join(t.options.AllowedTools, ","))
+	t.stdout, err = t.cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
 
-	if t.options.MaxTurns != nil {
-		cmd = append(cmd, "--max-turns", fmt.Sprintf("%d", *t.options.MaxTurns))
+	t.stderr, err = t.cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to create stderr pipe: %w", err)
 	}
+	t.stdoutReader, t.stdoutPeeked = t.stdout, nil
+	t.stderrReader, t.stderrRead = t.stderr, nil
 
-	if len(t.options.DisallowedTools) > 0 {
-		cmd = append(cmd, "--disallowedTools", strings.Join(t.options.DisallowedTools, ","))
+	// Start the process
+	if err := t.cmd.Start(); err != nil {
+		// Check if error is due to working directory
+		if t.options.Cwd != "" {
+			if _, statErr := os.Stat(t.options.Cwd); os.IsNotExist(statErr) {
+				return NewCLIConnectionError(fmt.Sprintf("Working directory does not exist: %s", t.options.Cwd))
+			}
+		}
+		// Check if error is due to CLI not found
+		if _, statErr := os.Stat(t.cliPath); os.IsNotExist(statErr) {
+			return NewCLINotFoundError(fmt.Sprintf("Claude Code not found at: %s", t.cliPath), t.cliPath)
+		}
+		return NewProcessError("Failed to start Claude Code", 0, err.Error())
 	}
 
-	if t.options.Model != "" {
-		cmd = append(cmd, "--model", t.options.Model)
+	// Limit the process as soon as it has started
+	if err := applyResourceLimits(t.cmd.Process.Pid, t.options.ResourceLimits); err != nil {
+		_ = t.cmd.Process.Kill()
+		_ = t.cmd.Wait()
+		return NewCLIConnectionError(fmt.Sprintf("Failed to apply resource limits: %v", err))
 	}
 
-	if t.options.PermissionPromptToolName != "" {
-		cmd = append(cmd, "--permission-prompt-tool", t.options.PermissionPromptToolName)
+	t.spawnedAt = t.clock.Now()
+	return nil
+}
+
+// checkFlags waits up to flagCheckWindow for the CLI just started to write
+// output or exit. If it exits having written nothing to stdout and its
+// usage error names an adjustable flag not yet dropped, the process is
+// reaped and the flag returned, so Connect can start it again without the
+// flag. settled reports whether the CLI got past its argument checks, so
+// the result can be cached. t.mu is released while waiting.
+func (t *SubprocessCLITransport) checkFlags() (rejected string, settled bool) {
+	// The readers take over once checkFlags stops reading
+	stdout := bufio.NewReader(t.stdout)
+	peeked := make(chan struct{})
+	var peekErr error
+	go func() {
+		defer close(peeked)
+		_, peekErr = stdout.Peek(1)
+	}()
+	t.stdoutReader, t.stdoutPeeked = stdout, peeked
+
+	window := t.clock.After(flagCheckWindow)
+	ctx := t.ctx
+	t.mu.Unlock()
+	defer t.mu.Lock()
+
+	select {
+	case <-peeked:
+	case <-window:
+		return "", true
+	case <-ctx.Done():
+		return "", false
+	}
+	if peekErr == nil {
+		return "", true
 	}
 
-	if t.options.PermissionMode != "" {
-		cmd = append(cmd, "--permission-mode", string(t.options.PermissionMode))
+	// Stdout ended without output, so the CLI is exiting; stderr says why
+	stderr := t.stderr
+	read := make(chan struct{})
+	var head []byte
+	go func() {
+		defer close(read)
+		head, _ = io.ReadAll(io.LimitReader(stderr, maxStderrSize))
+		t.stderrReader = io.MultiReader(bytes.NewReader(head), stderr)
+	}()
+	t.stderrRead = read
+
+	select {
+	case <-read:
+	case <-window:
+		return "", false
+	case <-ctx.Done():
+		return "", false
 	}
 
-	if t.options.ContinueConversation {
-		cmd = append(cmd, "--continue")
+	match := unknownFlagPattern.FindSubmatch(head)
+	if match == nil || !adjustableFlags[string(match[1])] || t.droppedFlags[string(match[1])] {
+		return "", false
 	}
 
-	if t.options.Resume != "" {
-		cmd = append(cmd, "--resume", t.options.Resume)
+	// Both pipes are at their end, so the process can be reaped here
+	_ = t.cmd.Wait()
+	return string(match[1]), false
+}
+
+// withoutFlags removes the dropped flags from args. Adjustable flags take
+// no value.
+func withoutFlags(args []string, dropped map[string]bool) []string {
+	if len(dropped) == 0 {
+		return args
 	}
 
-	if len(t.options.MCPServers) > 0 {
-		mcpConfig := map[string]any{"mcpServers": t.options.MCPServers}
-		configJSON, _ := json.Marshal(mcpConfig)
-		cmd = append(cmd, "--mcp-config", string(configJSON))
+	kept := make([]string, 0, len(args))
+	for _, arg := range args {
+		if !dropped[arg] {
+			kept = append(kept, arg)
+		}
 	}
+	return kept
+}
+
+// buildCommand builds the CLI command line from the transport's flags,
+// less any dropped ones, and promptArgs.
+func (t *SubprocessCLITransport) buildCommand(promptArgs []string) []string {
+	return append(withoutFlags(t.options.Args(), t.droppedFlags), promptArgs...)
+}
+
+// promptArgs returns the arguments for the prompt mode. In string mode it
+// reads the prompt from the stream.
+func (t *SubprocessCLITransport) promptArgs() []string {
+	var cmd []string
 
 	// Add prompt handling based on mode
 	if t.isStreaming {
@@ -452,8 +785,54 @@ func (t *SubprocessCLITransport) buildCommand() []string {
 	return cmd
 }
 
-// findCLI locates the Claude Code CLI executable.
-func (t *SubprocessCLITransport) findCLI() (string, error) {
+// spillSystemPrompt moves a --system-prompt value longer than
+// maxInlineSystemPrompt into a temp file passed with --system-prompt-file,
+// keeping the command line within the operating system's limits.
+func (t *SubprocessCLITransport) spillSystemPrompt(args []string) ([]string, error) {
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] != "--system-prompt" || len(args[i+1]) <= maxInlineSystemPrompt {
+			continue
+		}
+		path, err := t.createTempFile("claude-system-prompt-*.txt", []byte(args[i+1]))
+		if err != nil {
+			return nil, NewCLIConnectionError(fmt.Sprintf("Failed to write system prompt file: %v", err))
+		}
+		args[i], args[i+1] = "--system-prompt-file", path
+		break
+	}
+	return args, nil
+}
+
+// createTempFile writes data to a new file in Options.TempDir, or the
+// default temp directory, and records it for removal on Disconnect.
+func (t *SubprocessCLITransport) createTempFile(pattern string, data []byte) (string, error) {
+	file, err := os.CreateTemp(t.options.TempDir, pattern)
+	if err != nil {
+		return "", err
+	}
+	t.tempFiles = append(t.tempFiles, file.Name())
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// removeTempFiles removes the files created by createTempFile.
+func (t *SubprocessCLITransport) removeTempFiles() {
+	for _, path := range t.tempFiles {
+		_ = os.Remove(path)
+	}
+	t.tempFiles = nil
+}
+
+// FindCLI locates the Claude Code CLI: CLAUDE_CODE_CLI_PATH if set, then
+// PATH, then common installation directories.
+func FindCLI() (string, error) {
 	// Check CLAUDE_CODE_CLI_PATH environment variable
 	if path := os.Getenv("CLAUDE_CODE_CLI_PATH"); path != "" {
 		if _, err := os.Stat(path); err == nil {
@@ -519,17 +898,132 @@ func (t *SubprocessCLITransport) findCLI() (string, error) {
 // handleStdin manages writing to stdin in streaming mode.
 func (t *SubprocessCLITransport) handleStdin() {
 	defer t.taskGroup.Done()
+	defer close(t.stdinDone)
 
-	for data := range t.stdinChan {
+	firstInput := t.firstInput
+
+	for write := range t.stdinChan {
+		if write.data == nil {
+			// Input closed via CloseInput
+			t.stdin.Close()
+			break
+		}
 		if t.stdin == nil {
 			break
 		}
-		
-		if _, err := t.stdin.Write(data); err != nil {
-			t.safeSend(MessageData{Err: fmt.Errorf("failed to write to stdin: %w", err), Data: nil})
+
+		// Skip messages whose send was abandoned while queued
+		if err := write.ctx.Err(); err != nil {
+			write.done <- err
+			continue
+		}
+
+		if _, err := t.stdin.Write(write.data); err != nil {
+			t.stdinErrMu.Lock()
+			t.stdinErr = err
+			t.stdinErrMu.Unlock()
+
+			err = stdinWriteError(err)
+			write.done <- err
+			t.safeSend(MessageData{Err: err, Data: nil})
 			break
 		}
+		if firstInput != nil {
+			close(firstInput)
+			firstInput = nil
+		}
+		write.done <- nil
+	}
+}
+
+// marshalMessage encodes an outbound message with Options.MarshalMessage,
+// or json.Marshal by default.
+func (t *SubprocessCLITransport) marshalMessage(msg map[string]any) ([]byte, error) {
+	if marshal := t.options.MarshalMessage; marshal != nil {
+		return marshal(msg)
+	}
+	return json.Marshal(msg)
+}
+
+// withMetadata returns a user message with Options.Metadata attached,
+// copying it rather than modifying the caller's map. Other messages, such
+// as control responses, and messages that already carry metadata are left
+// as they are.
+func (t *SubprocessCLITransport) withMetadata(msg map[string]any) map[string]any {
+	if len(t.options.Metadata) == 0 || msg["type"] != "user" {
+		return msg
+	}
+	if _, ok := msg["metadata"]; ok {
+		return msg
+	}
+
+	withMetadata := make(map[string]any, len(msg)+1)
+	for key, value := range msg {
+		withMetadata[key] = value
+	}
+	withMetadata["metadata"] = t.options.Metadata
+	return withMetadata
+}
+
+// writeStdin queues data for handleStdin and waits until it is written.
+// ctx bounds the whole send: if it ends while the message is still queued,
+// the message is skipped. A write already in progress is not interrupted,
+// since a partial message would corrupt the stream, but writeStdin stops
+// waiting for it.
+func (t *SubprocessCLITransport) writeStdin(ctx context.Context, data []byte) error {
+	write := stdinWrite{ctx: ctx, data: data, done: make(chan error, 1)}
+
+	select {
+	case t.stdinChan <- write:
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.stdinDone:
+		return t.stdinClosedError()
+	}
+
+	select {
+	case err := <-write.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.stdinDone:
+		// The write may have completed just before handleStdin stopped
+		select {
+		case err := <-write.done:
+			return err
+		default:
+			return t.stdinClosedError()
+		}
+	}
+}
+
+// stdinWriteError describes a failed stdin write. A broken pipe means the
+// CLI exited, or closed its input, before reading everything sent to it.
+func stdinWriteError(err error) error {
+	if errors.Is(err, syscall.EPIPE) {
+		return NewCLIConnectionError("subprocess exited before input was fully sent")
 	}
+	return fmt.Errorf("failed to write to stdin: %w", err)
+}
+
+// stdinClosedError explains why handleStdin stopped accepting writes.
+func (t *SubprocessCLITransport) stdinClosedError() error {
+	if err := t.stdinError(); err != nil {
+		return err
+	}
+	return NewCLIConnectionError("Stdin closed")
+}
+
+// stdinError returns an error if an earlier stdin write failed, since no
+// further input can reach the process.
+func (t *SubprocessCLITransport) stdinError() error {
+	t.stdinErrMu.Lock()
+	defer t.stdinErrMu.Unlock()
+
+	if t.stdinErr != nil {
+		return NewCLIConnectionError(fmt.Sprintf("Cannot send: writing to stdin failed earlier: %v", t.stdinErr))
+	}
+	return nil
 }
 
 // streamToStdin streams messages to stdin for streaming mode.
@@ -559,45 +1053,52 @@ func (t *SubprocessCLITransport) streamToStdin() {
 			msg["session_id"] = t.sessionID
 		}
 
-		data, err := json.Marshal(msg)
+		data, err := t.marshalMessage(t.withMetadata(msg))
 		if err != nil {
 			t.safeSend(MessageData{Data: nil, Err: fmt.Errorf("failed to marshal prompt message: %w", err)})
 			return
 		}
 
-		select {
-		case t.stdinChan <- append(data, '\n'):
-		case <-t.ctx.Done():
+		if err := t.writeStdin(t.ctx, append(data, '\n')); err != nil {
 			return
 		}
 	}
 
-	// Close stdin after prompt if requested
-	if t.closeStdinAfterPrompt {
-		t.mu.Lock()
-		if t.stdin != nil {
-			t.stdin.Close()
-			t.stdin = nil
-		}
-		t.mu.Unlock()
+	// Close stdin after prompt if requested, by the caller or the prompt
+	if t.closeStdinAfterPrompt || closesInputAtEnd(t.prompt) {
+		t.CloseInput()
 	}
 }
 
 // readOutput reads and processes stdout.
 func (t *SubprocessCLITransport) readOutput() {
 	defer t.taskGroup.Done()
+	defer t.pipesRead.Done()
 
-	scanner := bufio.NewScanner(t.stdout)
+	if t.stdoutPeeked != nil {
+		<-t.stdoutPeeked
+	}
+	scanner := bufio.NewScanner(t.stdoutReader)
 	scanner.Buffer(make([]byte, maxBufferSize), maxBufferSize)
 
 	jsonBuffer := ""
+	firstOutput := t.firstOutput
 
 	for scanner.Scan() {
+		if firstOutput != nil {
+			close(firstOutput)
+			firstOutput = nil
+		}
+
 		line := scanner.Text()
 		if line == "" {
 			continue
 		}
 
+		if t.options.DebugRawOutput {
+			log.Printf("claude: raw output line: %s", line)
+		}
+
 		// Handle multiple JSON objects on same line
 		jsonLines := strings.Split(line, "\n")
 		
@@ -608,70 +1109,195 @@ func (t *SubprocessCLITransport) readOutput() {
 			}
 
 			// Accumulate JSON until we can parse it
-			jsonBuffer += jsonLine
-
-			if len(jsonBuffer) > maxBufferSize {
+			if size := len(jsonBuffer) + len(jsonLine); size > maxBufferSize {
 				jsonBuffer = ""
-				t.safeSend(MessageData{
-					Data: nil,
-					Err: NewCLIJSONDecodeError(
-						fmt.Sprintf("JSON message exceeded maximum buffer size of %d bytes", maxBufferSize),
-						fmt.Errorf("buffer size exceeded"),
-					),
-				})
+				t.safeSend(MessageData{Data: nil, Err: NewMessageTooLargeError(maxBufferSize, size)})
 				continue
 			}
 
-			// Try to parse accumulated buffer
-			var data map[string]any
-			if err := json.Unmarshal([]byte(jsonBuffer), &data); err == nil {
-				jsonBuffer = ""
+			// Decode as many complete objects as the line completes; an
+			// incomplete trailing object stays buffered for the next line
+			jsonBuffer = t.decodeLine(jsonBuffer, jsonLine)
+		}
+	}
 
-				// Handle control responses separately
-				if data["type"] == "control_response" {
-					if response, ok := data["response"].(map[string]any); ok {
-						if requestID, ok := response["request_id"].(string); ok {
-							t.mu.Lock()
-							t.pendingControlResponses[requestID] = response
-							t.mu.Unlock()
-						}
-					}
-					continue
-				}
+	// A single line longer than the scanner buffer ends the scan
+	err := scanner.Err()
+	if errors.Is(err, bufio.ErrTooLong) {
+		t.safeSend(MessageData{Data: nil, Err: NewMessageTooLargeError(maxBufferSize, maxBufferSize)})
+		return
+	}
+
+	// cmd.Wait, or Disconnect after a kill, can close stdout while it is
+	// being read, which ends the scan with os.ErrClosed rather than io.EOF
+	if err != nil && err != io.EOF && !errors.Is(err, os.ErrClosed) {
+		t.safeSend(MessageData{Data: nil, Err: fmt.Errorf("error reading output: %w", err)})
+	}
+
+	// Output that ended mid-object, e.g. because the CLI was killed, is
+	// reported rather than dropped
+	if err == nil && jsonBuffer != "" {
+		t.safeSend(MessageData{Data: nil, Err: NewCLIJSONDecodeError(jsonBuffer, io.ErrUnexpectedEOF)})
+	}
+}
+
+// watchFirstOutput kills the process and reports a StartupTimeoutError if
+// it writes nothing to stdout within timeout, e.g. because it is waiting
+// for an interactive login. In streaming mode the timeout starts at the
+// first stdin write, so an idle interactive session isn't killed. It runs
+// in taskGroup, so the error is sent before outChan is closed.
+func (t *SubprocessCLITransport) watchFirstOutput(timeout time.Duration) {
+	defer t.taskGroup.Done()
+
+	if t.firstInput != nil {
+		select {
+		case <-t.firstInput:
+		case <-t.firstOutput:
+			return
+		case <-t.processDone:
+			return
+		case <-t.ctx.Done():
+			return
+		}
+	}
 
-				t.safeSend(MessageData{Data: data, Err: nil})
+	select {
+	case <-t.clock.After(timeout):
+		// The process may have exited just as the timeout fired
+		select {
+		case <-t.processDone:
+			return
+		default:
+		}
+		t.safeSend(MessageData{Data: nil, Err: NewStartupTimeoutError(timeout)})
+		_ = t.cmd.Process.Kill()
+	case <-t.firstOutput:
+	case <-t.processDone:
+	case <-t.ctx.Done():
+	}
+}
+
+// decodeLine decodes a line of output appended to pending, the incomplete
+// object left by earlier lines, and returns what is still incomplete. The
+// CLI writes one message per line, so a syntax error is reported once as a
+// CLIJSONDecodeError and the rest of the line dropped, resyncing at the
+// next line. If line can't complete pending, pending is reported on its own
+// and line decoded afresh.
+func (t *SubprocessCLITransport) decodeLine(pending, line string) string {
+	rest, decoded, err := t.decodeBuffer(pending + line)
+	if err != nil && !decoded && pending != "" {
+		t.safeSend(MessageData{Data: nil, Err: NewCLIJSONDecodeError(pending, err)})
+		rest, _, err = t.decodeBuffer(line)
+	}
+	if err != nil {
+		t.safeSend(MessageData{Data: nil, Err: NewCLIJSONDecodeError(rest, err)})
+		return ""
+	}
+	return rest
+}
+
+// decodeBuffer decodes consecutive JSON objects from buffer and returns the
+// unconsumed remainder, whether any object was decoded, and the error that
+// stopped decoding, if it wasn't just an incomplete object.
+func (t *SubprocessCLITransport) decodeBuffer(buffer string) (rest string, decoded bool, err error) {
+	for buffer != "" {
+		decoder := json.NewDecoder(strings.NewReader(buffer))
+
+		var data map[string]any
+		err = decoder.Decode(&data)
+		if err == nil {
+			if t.options.DebugRawOutput {
+				log.Printf("claude: parsed %d bytes", decoder.InputOffset())
+			}
+			buffer = strings.TrimSpace(buffer[decoder.InputOffset():])
+			decoded = true
+			t.handleMessage(data)
+			continue
+		}
+
+		if err == io.EOF {
+			return "", decoded, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			// Incomplete object, keep accumulating
+			if t.options.DebugRawOutput {
+				log.Printf("claude: incomplete JSON, buffering %d bytes", len(buffer))
 			}
-			// If JSON parsing failed, continue accumulating
+			return buffer, decoded, nil
 		}
+
+		if t.options.DebugRawOutput {
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				log.Printf("claude: failed to parse at offset %d: %v", syntaxErr.Offset, err)
+			} else {
+				log.Printf("claude: failed to parse: %v", err)
+			}
+		}
+		return buffer, decoded, err
 	}
+	return "", decoded, nil
+}
 
-	if err := scanner.Err(); err != nil && err != io.EOF {
-		t.safeSend(MessageData{Data: nil, Err: fmt.Errorf("error reading output: %w", err)})
+// observeControl passes a control message to Options.OnControl, if set.
+func (t *SubprocessCLITransport) observeControl(direction byte, payload map[string]any) {
+	if t.options.OnControl != nil {
+		t.options.OnControl(direction, payload)
+	}
+}
+
+// handleMessage routes a decoded stdout message.
+func (t *SubprocessCLITransport) handleMessage(data map[string]any) {
+	if data["type"] == "control_request" || data["type"] == "control_response" {
+		t.observeControl(ControlReceived, data)
+	}
+
+	// Handle control responses separately
+	if data["type"] == "control_response" {
+		if response, ok := data["response"].(map[string]any); ok {
+			if requestID, ok := response["request_id"].(string); ok {
+				// Only responses someone is waiting for are kept, so a
+				// duplicate ack for a resent request is dropped
+				t.mu.Lock()
+				if _, waiting := t.pendingControlResponses[requestID]; waiting {
+					t.pendingControlResponses[requestID] = response
+				}
+				t.mu.Unlock()
+			}
+		}
+		return
 	}
+
+	t.safeSend(MessageData{Data: data, Err: nil})
 }
 
 // readStderr reads and accumulates stderr output.
 func (t *SubprocessCLITransport) readStderr() {
 	defer t.taskGroup.Done()
 
-	// Use a timer to enforce stderr timeout
-	timer := time.NewTimer(stderrTimeout)
-	defer timer.Stop()
+	// Enforce the stderr timeout
+	timeout := t.clock.After(stderrTimeout)
 
 	stderrLines := make([]string, 0)
 	stderrSize := 0
 	
-	scanner := bufio.NewScanner(t.stderr)
 	stderrChan := make(chan string, 100)
 	done := make(chan bool)
+	stop := make(chan struct{})
+	defer close(stop)
 
-	// Read stderr in a goroutine
+	// Read stderr in a goroutine. Once collection stops, lines are
+	// discarded so the pipe is still read to the end.
 	go func() {
+		defer t.pipesRead.Done()
+		if t.stderrRead != nil {
+			<-t.stderrRead
+		}
+		scanner := bufio.NewScanner(t.stderrReader)
 		for scanner.Scan() {
 			select {
 			case stderrChan <- scanner.Text():
-			case <-t.ctx.Done():
-				return
+			case <-stop:
 			}
 		}
 		close(done)
@@ -705,13 +1331,25 @@ func (t *SubprocessCLITransport) readStderr() {
 			stderrSize += lineSize
 
 		case <-done:
-			// Reading completed
+			// Reading completed; collect lines still buffered in stderrChan,
+			// which select may not have picked before done
+			for drained := false; !drained; {
+				select {
+				case line := <-stderrChan:
+					if stderrSize+len(line) <= maxStderrSize {
+						stderrLines = append(stderrLines, line)
+						stderrSize += len(line)
+					}
+				default:
+					drained = true
+				}
+			}
 			if len(stderrLines) > 0 {
 				t.processStderr(stderrLines)
 			}
 			return
 
-		case <-timer.C:
+		case <-timeout:
 			// Timeout reached
 			stderrLines = append(stderrLines, fmt.Sprintf("[stderr collection timed out after %v]", stderrTimeout))
 			t.processStderr(stderrLines)
@@ -732,12 +1370,19 @@ func (t *SubprocessCLITransport) processStderr(lines []string) {
 	stderrOutput := strings.Join(lines, "\n")
 	
 	// Wait for process exit code
+	select {
+	case <-t.processDone:
+	case <-t.ctx.Done():
+		return
+	}
+
 	var exitCode int
 	if t.cmd.ProcessState != nil {
 		exitCode = t.cmd.ProcessState.ExitCode()
 	}
 
-	// Only treat as error if exit code is non-zero
+	// Only treat as error if exit code is non-zero, unless any stderr
+	// output is considered a failure
 	if exitCode != 0 {
 		t.safeSend(MessageData{
 			Data: nil,
@@ -747,19 +1392,52 @@ func (t *SubprocessCLITransport) processStderr(lines []string) {
 				stderrOutput,
 			),
 		})
+	} else if t.options.TreatStderrAsError {
+		t.safeSend(MessageData{
+			Data: nil,
+			Err:  NewProcessError("Command wrote to stderr", exitCode, stderrOutput),
+		})
 	}
 }
 
 // sendControlRequest sends a control request and waits for response.
 func (t *SubprocessCLITransport) sendControlRequest(ctx context.Context, request map[string]any) (map[string]any, error) {
+	return t.sendControlRequestWithRetries(ctx, request, 0)
+}
+
+// sendControlRequestWithRetries sends a control request and waits for its
+// response, resending it under the same request ID up to retries times,
+// every controlRetryInterval, while no response has arrived. Without a
+// deadline on ctx, it gives up after Options.ControlTimeout.
+func (t *SubprocessCLITransport) sendControlRequestWithRetries(ctx context.Context, request map[string]any, retries int) (map[string]any, error) {
+	// Don't wait forever on a CLI that never answers
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := t.options.ControlTimeout
+		if timeout <= 0 {
+			timeout = defaultControlTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	t.mu.Lock()
-	if t.stdin == nil || !t.connected {
+	if t.stdin == nil || !t.connected || t.inputClosed {
 		t.mu.Unlock()
 		return nil, NewCLIConnectionError("Not connected or stdin not available")
 	}
+	if err := t.stdinError(); err != nil {
+		t.mu.Unlock()
+		return nil, err
+	}
 	
-	// Generate unique request ID
-	requestID := fmt.Sprintf("req_%d_%d", atomic.AddUint64(&t.requestCounter, 1), time.Now().UnixNano())
+	// Generate unique request ID; the counter keeps IDs unique regardless
+	// of the configured prefix
+	prefix := t.options.RequestIDPrefix
+	if prefix == "" {
+		prefix = "req"
+	}
+	requestID := fmt.Sprintf("%s_%d_%d", prefix, atomic.AddUint64(&t.requestCounter, 1), time.Now().UnixNano())
 	
 	// Build control request
 	controlRequest := map[string]any{
@@ -767,36 +1445,57 @@ func (t *SubprocessCLITransport) sendControlRequest(ctx context.Context, request
 		"request_id": requestID,
 		"request":    request,
 	}
+
+	// Register the request so handleMessage keeps its response, unless too
+	// many are already waiting
+	maxPending := t.options.MaxPendingControl
+	if maxPending <= 0 {
+		maxPending = defaultMaxPendingControl
+	}
+	if len(t.pendingControlResponses) >= maxPending {
+		t.mu.Unlock()
+		return nil, NewCLIConnectionError(fmt.Sprintf("Too many pending control requests (limit %d)", maxPending))
+	}
+	t.pendingControlResponses[requestID] = nil
 	t.mu.Unlock()
 
+	defer func() {
+		t.mu.Lock()
+		delete(t.pendingControlResponses, requestID)
+		t.mu.Unlock()
+	}()
+
 	// Send request
-	data, err := json.Marshal(controlRequest)
+	data, err := t.marshalMessage(controlRequest)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal control request: %w", err)
 	}
+	data = append(data, '\n')
 
-	select {
-	case t.stdinChan <- append(data, '\n'):
-	case <-ctx.Done():
-		return nil, ctx.Err()
+	if err := t.writeStdin(ctx, data); err != nil {
+		return nil, err
 	}
+	t.observeControl(ControlSent, controlRequest)
 
 	// Wait for response
-	ticker := time.NewTicker(100 * time.Millisecond)
+	ticker := t.clock.NewTicker(100 * time.Millisecond)
 	defer ticker.Stop()
 
+	var retry <-chan time.Time
+	if retries > 0 {
+		retryTicker := t.clock.NewTicker(controlRetryInterval)
+		defer retryTicker.Stop()
+		retry = retryTicker.C()
+	}
+
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			t.mu.RLock()
-			response, found := t.pendingControlResponses[requestID]
+			response := t.pendingControlResponses[requestID]
 			t.mu.RUnlock()
 			
-			if found {
-				t.mu.Lock()
-				delete(t.pendingControlResponses, requestID)
-				t.mu.Unlock()
-				
+			if response != nil {
 				if subtype, ok := response["subtype"].(string); ok && subtype == "error" {
 					if errMsg, ok := response["error"].(string); ok {
 						return nil, NewCLIConnectionError(fmt.Sprintf("Control request failed: %s", errMsg))
@@ -806,6 +1505,14 @@ func (t *SubprocessCLITransport) sendControlRequest(ctx context.Context, request
 				return response, nil
 			}
 
+		case <-retry:
+			if err := t.writeStdin(ctx, data); err != nil {
+				return nil, err
+			}
+			if retries--; retries == 0 {
+				retry = nil
+			}
+
 		case <-ctx.Done():
 			return nil, ctx.Err()
 		}
@@ -841,8 +1548,21 @@ func NewStringPromptStream(prompt string) MessageStream {
 	return &stringPromptAdapter{prompt: prompt}
 }
 
-// IsStringPrompt checks if a MessageStream is a simple string prompt
+// IsStringPrompt checks if a MessageStream is a simple string prompt.
+// Besides this package's own adapter, any stream that reports
+// IsStreaming() == false is treated as a string prompt.
 func IsStringPrompt(stream MessageStream) bool {
-	_, ok := stream.(*stringPromptAdapter)
-	return ok
+	if s, ok := stream.(interface{ IsStreaming() bool }); ok {
+		return !s.IsStreaming()
+	}
+	return false
+}
+
+// closesInputAtEnd reports whether stream asks for stdin to be closed once
+// it ends, by implementing CloseInputAtEnd() returning true.
+func closesInputAtEnd(stream MessageStream) bool {
+	if s, ok := stream.(interface{ CloseInputAtEnd() bool }); ok {
+		return s.CloseInputAtEnd()
+	}
+	return false
 }
\ No newline at end of file
@@ -1,8 +1,19 @@
 package transport_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,7 +30,7 @@ func TestSubprocessCLITransport_StringPrompt(t *testing.T) {
 	defer cancel()
 
 	prompt := claude.NewStringPromptStream("What is 2+2?")
-	options := claude.NewOptions()
+	options := transport.NewOptions()
 
 	trans := transport.NewSubprocessCLITransport(prompt, options)
 
@@ -75,7 +86,7 @@ func TestSubprocessCLITransport_StreamingPrompt(t *testing.T) {
 		},
 	}
 
-	options := claude.NewOptions()
+	options := transport.NewOptions()
 	trans := transport.NewSubprocessCLITransport(prompt, options).
 		WithStreaming(true).
 		WithCloseStdinAfterPrompt(true)
@@ -110,7 +121,7 @@ func TestSubprocessCLITransport_Interactive(t *testing.T) {
 	defer cancel()
 
 	prompt := claude.NewEmptyStream()
-	options := claude.NewOptions()
+	options := transport.NewOptions()
 
 	trans := transport.NewSubprocessCLITransport(prompt, options).
 		WithStreaming(true).
@@ -142,6 +153,7 @@ func TestSubprocessCLITransport_Interactive(t *testing.T) {
 	receivedAssistant := false
 	
 	timeout := time.After(10 * time.Second)
+receive:
 	for {
 		select {
 		case msg := <-msgChan:
@@ -156,11 +168,10 @@ func TestSubprocessCLITransport_Interactive(t *testing.T) {
 				if err := trans.Interrupt(ctx); err == nil {
 					t.Log("Successfully sent interrupt")
 				}
-				return
+				break receive
 			}
 		case <-timeout:
-			t.Error("Timeout waiting for assistant message")
-			return
+			break receive
 		}
 	}
 
@@ -171,7 +182,7 @@ func TestSubprocessCLITransport_Interactive(t *testing.T) {
 
 func TestSubprocessCLITransport_CLINotFound(t *testing.T) {
 	prompt := claude.NewStringPromptStream("test")
-	options := claude.NewOptions()
+	options := transport.NewOptions()
 
 	trans := transport.NewSubprocessCLITransport(prompt, options).
 		WithCLIPath("/nonexistent/path/to/claude")
@@ -187,7 +198,7 @@ func TestSubprocessCLITransport_CLINotFound(t *testing.T) {
 
 func TestSubprocessCLITransport_InvalidWorkingDir(t *testing.T) {
 	prompt := claude.NewStringPromptStream("test")
-	options := claude.NewOptions()
+	options := transport.NewOptions()
 	options.Cwd = "/nonexistent/directory"
 
 	trans := transport.NewSubprocessCLITransport(prompt, options)
@@ -204,14 +215,14 @@ func TestSubprocessCLITransport_InvalidWorkingDir(t *testing.T) {
 func TestSubprocessCLITransport_Options(t *testing.T) {
 	prompt := claude.NewStringPromptStream("test")
 	
-	options := claude.NewOptions()
+	options := transport.NewOptions()
 	options.SystemPrompt = "You are a helpful assistant"
 	options.Model = "claude-3-sonnet"
 	options.AllowedTools = []string{"read", "write"}
 	options.DisallowedTools = []string{"execute"}
 	maxTurns := 5
 	options.MaxTurns = &maxTurns
-	options.PermissionMode = claude.PermissionModeAcceptEdits
+	options.PermissionMode = string(claude.PermissionModeAcceptEdits)
 
 	trans := transport.NewSubprocessCLITransport(prompt, options)
 	
@@ -221,17 +232,1801 @@ func TestSubprocessCLITransport_Options(t *testing.T) {
 	}
 }
 
-// testStream implements MessageStream for testing
-type testStream struct {
-	messages []map[string]any
-	index    int
+func TestSubprocessCLITransport_TrailingGarbage(t *testing.T) {
+	cliPath := writeFakeCLI(t, `printf '%s\n' '{"type":"system","subtype":"init"}x'
+printf '%s\n' '{"type":"result","subtype":"success"}'
+sleep 0.2
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), transport.NewOptions()).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	var types []string
+	decodeErrors := 0
+	for msg := range trans.ReceiveMessages(ctx) {
+		if msg.Err != nil {
+			var decodeErr *transport.CLIJSONDecodeError
+			if !errors.As(msg.Err, &decodeErr) {
+				t.Fatalf("Expected CLIJSONDecodeError, got %T: %v", msg.Err, msg.Err)
+			}
+			decodeErrors++
+			continue
+		}
+		types = append(types, msg.Data["type"].(string))
+	}
+
+	if decodeErrors != 1 {
+		t.Errorf("Expected exactly one decode error, got %d", decodeErrors)
+	}
+	if len(types) != 2 || types[0] != "system" || types[1] != "result" {
+		t.Errorf("Expected system and result messages, got %v", types)
+	}
 }
 
-func (s *testStream) Next(ctx context.Context) (map[string]any, error) {
-	if s.index >= len(s.messages) {
-		return nil, nil // EOF
+func TestSubprocessCLITransport_CorruptLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+	}{
+		// The nested objects of a corrupt message aren't messages
+		{name: "junk in nested object", output: `{"type":"assistant","message":{"id":"m1","content":[{"type":"text","text":"hi"}]x},"meta":{"type":"system","subtype":"bogus"}}`},
+		// A message cut off mid-line doesn't swallow the next one
+		{name: "unfinished line", output: `{"type":"assistant","message":{"content":[{"type":"text","text":"cut`},
 	}
-	msg := s.messages[s.index]
-	s.index++
-	return msg, nil
-}
\ No newline at end of file
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cliPath := writeFakeCLI(t, `printf '%s\n' '{"type":"system","subtype":"init"}'
+printf '%s\n' '`+tt.output+`'
+printf '%s\n' '{"type":"result","subtype":"success"}'
+sleep 0.2
+`)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), transport.NewOptions()).
+				WithCLIPath(cliPath)
+			if err := trans.Connect(ctx); err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer trans.Disconnect()
+
+			var types []string
+			decodeErrors := 0
+			for msg := range trans.ReceiveMessages(ctx) {
+				if msg.Err != nil {
+					var decodeErr *transport.CLIJSONDecodeError
+					if !errors.As(msg.Err, &decodeErr) {
+						t.Fatalf("Expected CLIJSONDecodeError, got %T: %v", msg.Err, msg.Err)
+					}
+					decodeErrors++
+					continue
+				}
+				types = append(types, fmt.Sprint(msg.Data["type"]))
+			}
+
+			if decodeErrors != 1 {
+				t.Errorf("Expected exactly one decode error, got %d", decodeErrors)
+			}
+			if len(types) != 2 || types[0] != "system" || types[1] != "result" {
+				t.Errorf("Expected system and result messages, got %v", types)
+			}
+		})
+	}
+}
+
+func TestSubprocessCLITransport_TruncatedOutput(t *testing.T) {
+	// The fake CLI exits partway through its second message
+	cliPath := writeFakeCLI(t, `printf '%s\n' '{"type":"system","subtype":"init"}'
+printf '%s\n' '{"type":"assistant","message":{"content":[{"type":"text","text":"cut'
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), transport.NewOptions()).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	var types []string
+	var decodeErr *transport.CLIJSONDecodeError
+	for msg := range trans.ReceiveMessages(ctx) {
+		if msg.Err != nil {
+			if !errors.As(msg.Err, &decodeErr) {
+				t.Fatalf("Expected CLIJSONDecodeError, got %T: %v", msg.Err, msg.Err)
+			}
+			continue
+		}
+		types = append(types, msg.Data["type"].(string))
+	}
+
+	if len(types) != 1 || types[0] != "system" {
+		t.Errorf("Expected only the complete system message, got %v", types)
+	}
+	if decodeErr == nil {
+		t.Fatal("Expected the truncated message to be reported")
+	}
+	if !strings.Contains(decodeErr.Line, `"text":"cut`) || !errors.Is(decodeErr.OriginalError, io.ErrUnexpectedEOF) {
+		t.Errorf("Unexpected decode error: line %q, cause %v", decodeErr.Line, decodeErr.OriginalError)
+	}
+}
+
+func TestSubprocessCLITransport_CloseInput(t *testing.T) {
+	// The fake CLI only answers once its stdin reaches EOF
+	cliPath := writeFakeCLI(t, `cat > /dev/null
+printf '%s\n' '{"type":"result","subtype":"success"}'
+sleep 0.2
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(&testStream{}, transport.NewOptions()).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	message := map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "hi"}}
+	if err := trans.SendRequest(ctx, []map[string]any{message}, nil); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+
+	if err := trans.CloseInput(); err != nil {
+		t.Fatalf("Failed to close input: %v", err)
+	}
+
+	if err := trans.SendRequest(ctx, []map[string]any{message}, nil); err == nil {
+		t.Error("Expected SendRequest to fail after CloseInput")
+	}
+
+	var types []string
+	for msg := range trans.ReceiveMessages(ctx) {
+		if msg.Err != nil {
+			t.Fatalf("Received error: %v", msg.Err)
+		}
+		types = append(types, msg.Data["type"].(string))
+	}
+
+	if len(types) != 1 || types[0] != "result" {
+		t.Errorf("Expected result after closing input, got %v", types)
+	}
+}
+
+func TestSubprocessCLITransport_IsConnectedAfterExit(t *testing.T) {
+	cliPath := writeFakeCLI(t, "sleep 0.2\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), transport.NewOptions()).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	// The channel closes once the process has exited
+	for range trans.ReceiveMessages(ctx) {
+	}
+
+	if trans.IsConnected() {
+		t.Error("Expected IsConnected to be false after the process exited")
+	}
+}
+
+// inputClosingStream is a testStream that asks for stdin to be closed at
+// its end.
+type inputClosingStream struct {
+	testStream
+}
+
+func (s *inputClosingStream) CloseInputAtEnd() bool {
+	return true
+}
+
+func TestSubprocessCLITransport_CloseInputAtEnd(t *testing.T) {
+	// The fake CLI echoes its input, then reports once stdin is closed
+	cliPath := writeFakeCLI(t, `cat
+echo '{"type":"result","subtype":"success"}'
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	prompt := &inputClosingStream{testStream{messages: []map[string]any{
+		{"type": "user", "message": map[string]any{"role": "user", "content": "only"}},
+	}}}
+	trans := transport.NewSubprocessCLITransport(prompt, transport.NewOptions()).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	var types []string
+	for msg := range trans.ReceiveMessages(ctx) {
+		if msg.Err != nil {
+			t.Fatalf("Received error: %v", msg.Err)
+		}
+		types = append(types, msg.Data["type"].(string))
+	}
+	if fmt.Sprint(types) != "[user result]" {
+		t.Errorf("Expected the echo and then the result after stdin closed, got %v", types)
+	}
+}
+
+// promptStream is a testStream that reports itself as a string prompt, as
+// the root package's string prompts do.
+type promptStream struct {
+	testStream
+}
+
+func (s *promptStream) IsStreaming() bool {
+	return false
+}
+
+func TestSubprocessCLITransport_StringPromptMode(t *testing.T) {
+	// The fake CLI reports its arguments, then waits for SIGINT
+	cliPath := writeFakeCLI(t, `trap 'echo "{\"type\":\"result\",\"subtype\":\"interrupted\"}"; exit 0' INT
+echo "{\"type\":\"system\",\"subtype\":\"init\",\"args\":\"$*\"}"
+sleep 5 >/dev/null 2>&1 &
+wait $!
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	prompt := &promptStream{testStream{messages: []map[string]any{
+		{"type": "user", "message": map[string]any{"role": "user", "content": "hello"}},
+	}}}
+	if !transport.IsStringPrompt(prompt) {
+		t.Fatal("Expected a stream reporting IsStreaming() == false to be a string prompt")
+	}
+
+	trans := transport.NewSubprocessCLITransport(prompt, transport.NewOptions()).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	if trans.IsStreaming() {
+		t.Error("Expected string prompt transport not to be streaming")
+	}
+
+	msgChan := trans.ReceiveMessages(ctx)
+	msg := <-msgChan
+	if msg.Err != nil {
+		t.Fatalf("Unexpected error: %v", msg.Err)
+	}
+	if args, _ := msg.Data["args"].(string); !strings.Contains(args, "--print hello") || strings.Contains(args, "--input-format") {
+		t.Errorf("Expected the prompt to be passed with --print, got args %q", args)
+	}
+
+	// Query and SendToolResult go through SendRequest, which needs stdin
+	err := trans.SendRequest(ctx, []map[string]any{{"type": "user"}}, nil)
+	var connErr *transport.CLIConnectionError
+	if !errors.As(err, &connErr) {
+		t.Errorf("Expected CLIConnectionError from SendRequest, got %v", err)
+	}
+	if _, err := trans.SendControlRequest(ctx, map[string]any{"subtype": "interrupt"}); !errors.As(err, &connErr) {
+		t.Errorf("Expected CLIConnectionError from SendControlRequest, got %v", err)
+	}
+
+	// Interrupt signals the process instead of sending a control request
+	if err := trans.Interrupt(ctx); err != nil {
+		t.Fatalf("Failed to interrupt: %v", err)
+	}
+	msg = <-msgChan
+	if msg.Err != nil || msg.Data["subtype"] != "interrupted" {
+		t.Errorf("Expected the CLI to handle SIGINT, got %+v", msg)
+	}
+}
+
+func TestSubprocessCLITransport_OnBackpressure(t *testing.T) {
+	cliPath := writeFakeCLI(t, `for i in 1 2 3 4 5 6 7 8 9 10; do
+  echo '{"type":"assistant","message":{"content":[]}}'
+done
+echo '{"type":"result","subtype":"success"}'
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	fired := make(chan int, transport.OutputBufferSize)
+	options := transport.NewOptions()
+	options.BufferHighWaterMark = 5
+	options.OnBackpressure = func(pending int) {
+		fired <- pending
+	}
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+	messages := trans.ReceiveMessages(ctx)
+
+	// Nothing reads the messages yet, so they build up in the buffer
+	select {
+	case pending := <-fired:
+		if pending != 6 {
+			t.Errorf("Expected the callback as the buffer passed the mark, got %d pending", pending)
+		}
+	case <-ctx.Done():
+		t.Fatal("Expected OnBackpressure to be called")
+	}
+
+	count := 0
+	for msg := range messages {
+		if msg.Err != nil {
+			t.Fatalf("Received error: %v", msg.Err)
+		}
+		count++
+	}
+	if count != 11 {
+		t.Errorf("Expected all 11 messages to be delivered, got %d", count)
+	}
+	if len(fired) != 0 {
+		t.Errorf("Expected one callback while the buffer stayed above the mark, got %d more", len(fired))
+	}
+}
+
+func TestSubprocessCLITransport_ReceiveMessagesAfterExit(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"result","subtype":"success"}'
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), transport.NewOptions()).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	for range trans.ReceiveMessages(ctx) {
+	}
+
+	// Once the output has ended, a later call gets a closed channel rather
+	// than a nil one that would block forever
+	select {
+	case _, ok := <-trans.ReceiveMessages(ctx):
+		if ok {
+			t.Error("Expected no more messages after the output ended")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected ReceiveMessages to return a closed channel after the output ended")
+	}
+}
+
+func TestSubprocessCLITransport_TempDir(t *testing.T) {
+	// The fake CLI reports the system prompt file it was given and whether
+	// it exists
+	cliPath := writeFakeCLI(t, `while [ $# -gt 0 ]; do
+  if [ "$1" = "--system-prompt-file" ]; then file="$2"; fi
+  shift
+done
+[ -f "$file" ] && exists=true || exists=false
+echo "{\"type\":\"result\",\"subtype\":\"success\",\"file\":\"$file\",\"exists\":$exists}"
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tempDir := t.TempDir()
+	options := transport.NewOptions()
+	options.SystemPrompt = strings.Repeat("x", 200*1024)
+	options.TempDir = tempDir
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	var result map[string]any
+	for msg := range trans.ReceiveMessages(ctx) {
+		if msg.Err != nil {
+			t.Fatalf("Received error: %v", msg.Err)
+		}
+		result = msg.Data
+	}
+	file, _ := result["file"].(string)
+	if filepath.Dir(file) != tempDir || result["exists"] != true {
+		t.Errorf("Expected an existing system prompt file in %s, got %v", tempDir, result)
+	}
+
+	if err := trans.Disconnect(); err != nil {
+		t.Fatalf("Failed to disconnect: %v", err)
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 0 {
+		t.Errorf("Expected temp files to be removed on Disconnect, found %d", len(entries))
+	}
+}
+
+func TestSubprocessCLITransport_PID(t *testing.T) {
+	// The fake CLI reports its own PID, then runs until its input closes
+	cliPath := writeFakeCLI(t, `echo "{\"type\":\"system\",\"subtype\":\"pid\",\"data\":{\"pid\":$$}}"
+cat >/dev/null
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(&testStream{}, transport.NewOptions()).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if _, ok := trans.PID(); ok {
+		t.Error("Expected no PID before Connect")
+	}
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+	messages := trans.ReceiveMessages(ctx)
+
+	msg := <-messages
+	if msg.Err != nil {
+		t.Fatalf("Received error: %v", msg.Err)
+	}
+	reported := int(msg.Data["data"].(map[string]any)["pid"].(float64))
+	if pid, ok := trans.PID(); !ok || pid != reported {
+		t.Errorf("Expected PID %d while running, got %d, %v", reported, pid, ok)
+	}
+
+	trans.CloseInput()
+	for range messages {
+	}
+	if pid, ok := trans.PID(); ok {
+		t.Errorf("Expected no PID after the process exited, got %d", pid)
+	}
+}
+
+func TestSubprocessCLITransport_TreatStderrAsError(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo "warning: deprecated flag" >&2
+sleep 0.2
+`)
+
+	for _, treatAsError := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+		options := transport.NewOptions()
+		options.TreatStderrAsError = treatAsError
+		trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+			WithCLIPath(cliPath)
+		if err := trans.Connect(ctx); err != nil {
+			cancel()
+			t.Fatalf("Failed to connect: %v", err)
+		}
+
+		var processErr *transport.ProcessError
+		for msg := range trans.ReceiveMessages(ctx) {
+			if msg.Err != nil && !errors.As(msg.Err, &processErr) {
+				t.Errorf("Unexpected error: %v", msg.Err)
+			}
+		}
+		trans.Disconnect()
+		cancel()
+
+		if treatAsError && processErr == nil {
+			t.Error("Expected ProcessError for stderr output with TreatStderrAsError")
+		}
+		if !treatAsError && processErr != nil {
+			t.Errorf("Expected no error without TreatStderrAsError, got %v", processErr)
+		}
+		if processErr != nil && processErr.Stderr != "warning: deprecated flag" {
+			t.Errorf("Expected stderr in error, got %q", processErr.Stderr)
+		}
+	}
+}
+
+func TestSubprocessCLITransport_RequestIDPrefix(t *testing.T) {
+	cliPath := writeFakeCLI(t, controlEchoScript)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.RequestIDPrefix = "trace-abc"
+	trans := transport.NewSubprocessCLITransport(&testStream{}, options).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	// Closing input ends the fake CLI, which closes the channel
+	messages := trans.ReceiveMessages(ctx)
+	defer func() {
+		trans.CloseInput()
+		for range messages {
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := trans.Interrupt(ctx); err != nil {
+			t.Fatalf("Interrupt failed: %v", err)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for len(seen) < 2 {
+		msg := <-messages
+		if msg.Err != nil {
+			t.Fatalf("Received error: %v", msg.Err)
+		}
+		requestID := msg.Data["data"].(map[string]any)["request_id"].(string)
+		if !strings.HasPrefix(requestID, "trace-abc_") {
+			t.Errorf("Expected request ID with prefix trace-abc_, got %s", requestID)
+		}
+		seen[requestID] = true
+	}
+}
+
+func TestSubprocessCLITransport_OnControl(t *testing.T) {
+	cliPath := writeFakeCLI(t, controlEchoScript)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var mu sync.Mutex
+	var directions []byte
+	var payloads []map[string]any
+	options := transport.NewOptions()
+	options.OnControl = func(direction byte, payload map[string]any) {
+		mu.Lock()
+		defer mu.Unlock()
+		directions = append(directions, direction)
+		payloads = append(payloads, payload)
+	}
+	trans := transport.NewSubprocessCLITransport(&testStream{}, options).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	messages := trans.ReceiveMessages(ctx)
+	defer func() {
+		trans.CloseInput()
+		for range messages {
+		}
+	}()
+
+	if err := trans.Interrupt(ctx); err != nil {
+		t.Fatalf("Interrupt failed: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if string(directions) != string([]byte{transport.ControlSent, transport.ControlReceived}) {
+		t.Fatalf("Expected a sent request and a received response, got %q", directions)
+	}
+	request, response := payloads[0], payloads[1]
+	if request["type"] != "control_request" || request["request"].(map[string]any)["subtype"] != "interrupt" {
+		t.Errorf("Unexpected observed request: %v", request)
+	}
+	responseBody, _ := response["response"].(map[string]any)
+	if response["type"] != "control_response" || responseBody["request_id"] != request["request_id"] {
+		t.Errorf("Expected the response to request %v, got %v", request["request_id"], response)
+	}
+}
+
+func TestSubprocessCLITransport_DebugRawOutput(t *testing.T) {
+	malformed := `{"type": oops}`
+	cliPath := writeFakeCLI(t, `printf '%s\n' '{"type":"system","subtype":"init"}'
+printf '%s\n' '`+malformed+`'
+sleep 0.2
+`)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.DebugRawOutput = true
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	for range trans.ReceiveMessages(ctx) {
+	}
+
+	var expected *json.SyntaxError
+	var data map[string]any
+	if err := json.NewDecoder(strings.NewReader(malformed)).Decode(&data); !errors.As(err, &expected) {
+		t.Fatalf("Expected syntax error decoding %s, got %v", malformed, err)
+	}
+
+	output := logs.String()
+	if !strings.Contains(output, "raw output line: "+malformed) {
+		t.Errorf("Expected malformed line to be logged, got:\n%s", output)
+	}
+	if !strings.Contains(output, fmt.Sprintf("failed to parse at offset %d", expected.Offset)) {
+		t.Errorf("Expected parse failure with offset %d to be logged, got:\n%s", expected.Offset, output)
+	}
+}
+
+func TestSubprocessCLITransport_BrokenStdin(t *testing.T) {
+	// The fake CLI closes its stdin, so writes fail with a broken pipe
+	cliPath := writeFakeCLI(t, `exec 0<&-
+sleep 0.5
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(&testStream{}, transport.NewOptions()).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	messages := trans.ReceiveMessages(ctx)
+	defer func() {
+		for range messages {
+		}
+	}()
+
+	// Give the fake CLI time to close stdin
+	time.Sleep(100 * time.Millisecond)
+
+	message := map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "hi"}}
+	err := trans.SendRequest(ctx, []map[string]any{message}, nil)
+	var connErr *transport.CLIConnectionError
+	if !errors.As(err, &connErr) || err.Error() != "subprocess exited before input was fully sent" {
+		t.Fatalf("Expected the broken pipe to be reported as an early exit, got %v", err)
+	}
+
+	msg := <-messages
+	if msg.Err == nil {
+		t.Fatalf("Expected write failure, got message %v", msg.Data)
+	}
+
+	err = trans.SendRequest(ctx, []map[string]any{message}, nil)
+	if !errors.As(err, &connErr) {
+		t.Errorf("Expected CLIConnectionError after stdin failure, got %v", err)
+	}
+	if err := trans.Interrupt(ctx); err == nil {
+		t.Error("Expected Interrupt to fail after stdin failure")
+	}
+}
+
+func TestSubprocessCLITransport_MaxTokens(t *testing.T) {
+	cliPath := writeFakeCLI(t, `printf '{"type":"system","subtype":"env","data":{"max_tokens":"%s"}}\n' "${CLAUDE_CODE_MAX_OUTPUT_TOKENS-unset}"
+sleep 0.2
+`)
+
+	maxTokens := 2048
+	for _, tt := range []struct {
+		maxTokens *int
+		want      string
+	}{
+		{nil, "unset"},
+		{&maxTokens, "2048"},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+		// A clean environment keeps an inherited value out of the way
+		options := transport.NewOptions()
+		options.CleanEnv = true
+		options.MaxTokens = tt.maxTokens
+		trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+			WithCLIPath(cliPath)
+		if err := trans.Connect(ctx); err != nil {
+			cancel()
+			t.Fatalf("Failed to connect: %v", err)
+		}
+
+		var got any
+		for msg := range trans.ReceiveMessages(ctx) {
+			if msg.Err != nil {
+				t.Fatalf("Unexpected error: %v", msg.Err)
+			}
+			got = msg.Data["data"].(map[string]any)["max_tokens"]
+		}
+		trans.Disconnect()
+		cancel()
+
+		if got != tt.want {
+			t.Errorf("Expected CLAUDE_CODE_MAX_OUTPUT_TOKENS %q, got %v", tt.want, got)
+		}
+	}
+}
+
+func TestSubprocessCLITransport_MessageTooLarge(t *testing.T) {
+	// An unterminated string spread over two 600KB lines accumulates past
+	// the 1MB buffer limit
+	cliPath := writeFakeCLI(t, `printf '%s\n' '{"type":"assistant","text":"'
+head -c 600000 /dev/zero | tr '\0' a; echo
+head -c 600000 /dev/zero | tr '\0' a; echo
+printf '%s\n' '{"type":"result","subtype":"success"}'
+sleep 0.2
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), transport.NewOptions()).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	var tooLarge *transport.MessageTooLargeError
+	var types []string
+	for msg := range trans.ReceiveMessages(ctx) {
+		if msg.Err != nil {
+			var decodeErr *transport.CLIJSONDecodeError
+			if errors.As(msg.Err, &decodeErr) {
+				t.Errorf("Expected a size error, got decode error: %v", msg.Err)
+			}
+			if !errors.As(msg.Err, &tooLarge) {
+				t.Fatalf("Expected MessageTooLargeError, got %T: %v", msg.Err, msg.Err)
+			}
+			continue
+		}
+		types = append(types, msg.Data["type"].(string))
+	}
+
+	if tooLarge == nil {
+		t.Fatal("Expected a MessageTooLargeError")
+	}
+	if tooLarge.Limit != 1024*1024 || tooLarge.Size <= tooLarge.Limit {
+		t.Errorf("Expected size above the 1MB limit, got limit %d and size %d", tooLarge.Limit, tooLarge.Size)
+	}
+	if len(types) != 1 || types[0] != "result" {
+		t.Errorf("Expected reading to continue with the result message, got %v", types)
+	}
+}
+
+func TestSubprocessCLITransport_CleanEnv(t *testing.T) {
+	cliPath := writeFakeCLI(t, `printf '{"type":"system","subtype":"env","data":{"inherited":"%s","provided":"%s","entrypoint":"%s"}}\n' "${SDK_TEST_INHERITED-}" "${SDK_TEST_PROVIDED-}" "${CLAUDE_CODE_ENTRYPOINT-}"
+sleep 0.2
+`)
+	t.Setenv("SDK_TEST_INHERITED", "leaked")
+
+	for _, clean := range []bool{false, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+		options := transport.NewOptions()
+		options.Env = map[string]string{"SDK_TEST_PROVIDED": "provided"}
+		options.CleanEnv = clean
+		trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+			WithCLIPath(cliPath)
+		if err := trans.Connect(ctx); err != nil {
+			cancel()
+			t.Fatalf("Failed to connect: %v", err)
+		}
+
+		var env map[string]any
+		for msg := range trans.ReceiveMessages(ctx) {
+			if msg.Err != nil {
+				t.Fatalf("Unexpected error: %v", msg.Err)
+			}
+			env, _ = msg.Data["data"].(map[string]any)
+		}
+		trans.Disconnect()
+		cancel()
+
+		wantInherited := "leaked"
+		if clean {
+			wantInherited = ""
+		}
+		if env["inherited"] != wantInherited {
+			t.Errorf("CleanEnv=%v: expected inherited var %q, got %q", clean, wantInherited, env["inherited"])
+		}
+		if env["provided"] != "provided" {
+			t.Errorf("CleanEnv=%v: expected provided var, got %q", clean, env["provided"])
+		}
+		if env["entrypoint"] != "sdk-go" {
+			t.Errorf("CleanEnv=%v: expected entrypoint 'sdk-go', got %q", clean, env["entrypoint"])
+		}
+	}
+}
+
+func TestSubprocessCLITransport_CLILocator(t *testing.T) {
+	cliPath := writeFakeCLI(t, `echo '{"type":"system","subtype":"located"}'
+sleep 0.2
+`)
+	// The built-in search would fail
+	t.Setenv("CLAUDE_CODE_CLI_PATH", filepath.Join(t.TempDir(), "missing"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.CLILocator = func() (string, error) { return cliPath, nil }
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	var subtypes []string
+	for msg := range trans.ReceiveMessages(ctx) {
+		if msg.Err != nil {
+			t.Fatalf("Unexpected error: %v", msg.Err)
+		}
+		subtypes = append(subtypes, msg.Data["subtype"].(string))
+	}
+	if len(subtypes) != 1 || subtypes[0] != "located" {
+		t.Errorf("Expected output from the located CLI, got %v", subtypes)
+	}
+
+	// Locator errors fail Connect as they are
+	locateErr := errors.New("no CLI here")
+	options.CLILocator = func() (string, error) { return "", locateErr }
+	trans = transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options)
+	if err := trans.Connect(ctx); !errors.Is(err, locateErr) {
+		t.Errorf("Expected locator error, got %v", err)
+	}
+}
+
+func TestSubprocessCLITransport_ResourceLimits(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("resource limit enforcement is only tested on Linux")
+	}
+
+	// Reports its limits once they have been applied, then tries to hold
+	// 100MB in memory
+	cliPath := writeFakeCLI(t, `sleep 0.1
+printf '{"type":"system","subtype":"limits","data":{"memory":"%s","cpu":"%s"}}\n' "$(ulimit -v)" "$(ulimit -t)"
+x=$(head -c 100000000 /dev/zero | tr '\0' a)
+echo '{"type":"system","subtype":"allocated"}'
+sleep 0.2
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.ResourceLimits = &transport.ResourceLimits{
+		MaxMemoryBytes: 64 * 1024 * 1024,
+		MaxCPUTime:     1500 * time.Millisecond,
+	}
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	var limits map[string]any
+	allocated := false
+	for msg := range trans.ReceiveMessages(ctx) {
+		if msg.Err != nil {
+			continue // the process is expected to die
+		}
+		switch msg.Data["subtype"] {
+		case "limits":
+			limits, _ = msg.Data["data"].(map[string]any)
+		case "allocated":
+			allocated = true
+		}
+	}
+
+	if limits["memory"] != "65536" || limits["cpu"] != "2" {
+		t.Errorf("Expected 65536 KiB and 2s limits, got %v", limits)
+	}
+	if allocated {
+		t.Error("Expected the allocation to fail under the memory limit")
+	}
+}
+
+func TestSubprocessCLITransport_ResourceLimitsMissingCLI(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.ResourceLimits = &transport.ResourceLimits{MaxMemoryBytes: 64 * 1024 * 1024, MaxCPUTime: time.Second}
+	cliPath := filepath.Join(t.TempDir(), "missing-claude")
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+		WithCLIPath(cliPath)
+
+	err := trans.Connect(ctx)
+	var notFound *transport.CLINotFoundError
+	if !errors.As(err, &notFound) || notFound.CLIPath != cliPath {
+		t.Errorf("Expected CLINotFoundError for %s with limits set, got %v", cliPath, err)
+	}
+}
+
+func TestSubprocessCLITransport_FirstMessageTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      string
+		wantTimeout bool
+		wantCount   int
+	}{
+		{name: "silent", script: "exec sleep 5\n", wantTimeout: true},
+		{name: "slow after first message", script: `echo '{"type":"system","subtype":"init"}'
+sleep 0.4
+echo '{"type":"system","subtype":"late"}'
+sleep 0.2
+`, wantCount: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cliPath := writeFakeCLI(t, tt.script)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			options := transport.NewOptions()
+			options.FirstMessageTimeout = 200 * time.Millisecond
+			trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+				WithCLIPath(cliPath)
+			if err := trans.Connect(ctx); err != nil {
+				t.Fatalf("Failed to connect: %v", err)
+			}
+			defer trans.Disconnect()
+
+			start := time.Now()
+			var timeoutErr *transport.StartupTimeoutError
+			count := 0
+			for msg := range trans.ReceiveMessages(ctx) {
+				if msg.Err != nil {
+					if !errors.As(msg.Err, &timeoutErr) {
+						t.Errorf("Unexpected error: %v", msg.Err)
+					}
+					continue
+				}
+				count++
+			}
+
+			if got := timeoutErr != nil; got != tt.wantTimeout {
+				t.Errorf("Expected startup timeout %v, got error %v", tt.wantTimeout, timeoutErr)
+			}
+			if tt.wantTimeout && timeoutErr.Timeout != 200*time.Millisecond {
+				t.Errorf("Expected the configured timeout on the error, got %v", timeoutErr.Timeout)
+			}
+			if count != tt.wantCount {
+				t.Errorf("Expected %d messages, got %d", tt.wantCount, count)
+			}
+			if elapsed := time.Since(start); elapsed > 3*time.Second {
+				t.Errorf("Expected output to end promptly, took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestSubprocessCLITransport_FirstMessageTimeoutStreaming(t *testing.T) {
+	// Reads its first message but never replies
+	cliPath := writeFakeCLI(t, `read -r line
+exec sleep 5
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.FirstMessageTimeout = 200 * time.Millisecond
+	trans := transport.NewSubprocessCLITransport(&testStream{}, options).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+
+	// An idle session outlives the timeout, which starts with the first message
+	time.Sleep(400 * time.Millisecond)
+	if !trans.IsConnected() {
+		t.Fatal("Expected an idle streaming session to survive the first message timeout")
+	}
+
+	message := map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "hi"}}
+	sent := time.Now()
+	if err := trans.SendRequest(ctx, []map[string]any{message}, nil); err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+
+	var timeoutErr *transport.StartupTimeoutError
+	for msg := range trans.ReceiveMessages(ctx) {
+		if msg.Err != nil && errors.As(msg.Err, &timeoutErr) {
+			break
+		}
+		t.Errorf("Unexpected message: %+v", msg)
+	}
+	if timeoutErr == nil {
+		t.Error("Expected a startup timeout once a message went unanswered")
+	}
+	if elapsed := time.Since(sent); elapsed > 3*time.Second {
+		t.Errorf("Expected the timeout to count from the first message, took %v", elapsed)
+	}
+}
+
+func TestSubprocessCLITransport_SendControlRequest(t *testing.T) {
+	// Acknowledges control requests and reports each one it received
+	cliPath := writeFakeCLI(t, `while read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/.*"request_id":"\([^"]*\)".*/\1/p')
+  if [ -n "$id" ]; then
+    printf '{"type":"control_response","response":{"request_id":"%s","subtype":"success","response":{"ok":true}}}\n' "$id"
+    printf '{"type":"system","subtype":"control_seen","data":%s}\n' "$line"
+  fi
+done
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(&testStream{}, transport.NewOptions()).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	messages := trans.ReceiveMessages(ctx)
+	defer func() {
+		trans.CloseInput()
+		for range messages {
+		}
+	}()
+
+	response, err := trans.SendControlRequest(ctx, map[string]any{"subtype": "set_permission_mode", "mode": "acceptEdits"})
+	if err != nil {
+		t.Fatalf("SendControlRequest failed: %v", err)
+	}
+	if response["subtype"] != "success" {
+		t.Errorf("Expected a success response, got %v", response)
+	}
+
+	msg := <-messages
+	if msg.Err != nil {
+		t.Fatalf("Received error: %v", msg.Err)
+	}
+	request, _ := msg.Data["data"].(map[string]any)["request"].(map[string]any)
+	if request["subtype"] != "set_permission_mode" || request["mode"] != "acceptEdits" {
+		t.Errorf("Expected the request on the wire, got %v", msg.Data["data"])
+	}
+
+	stringMode := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("hi"), transport.NewOptions())
+	if _, err := stringMode.SendControlRequest(ctx, map[string]any{"subtype": "interrupt"}); err == nil {
+		t.Error("Expected error outside streaming mode")
+	}
+}
+
+func TestSubprocessCLITransport_InterruptRetries(t *testing.T) {
+	// Drops the first control request and acks every later one twice
+	cliPath := writeFakeCLI(t, `n=0
+while read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/.*"request_id":"\([^"]*\)".*/\1/p')
+  if [ -n "$id" ]; then
+    n=$((n+1))
+    if [ "$n" -gt 1 ]; then
+      printf '{"type":"control_response","response":{"request_id":"%s","subtype":"success"}}\n' "$id" "$id"
+      printf '{"type":"system","subtype":"control_seen","data":{"request_id":"%s"}}\n' "$id"
+    fi
+  fi
+done
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.InterruptRetries = 2
+	trans := transport.NewSubprocessCLITransport(&testStream{}, options).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	messages := trans.ReceiveMessages(ctx)
+	defer func() {
+		trans.CloseInput()
+		for range messages {
+		}
+	}()
+
+	// The first interrupt is acked on its resend, the second right away
+	var seen []string
+	for i := 0; i < 2; i++ {
+		if err := trans.Interrupt(ctx); err != nil {
+			t.Fatalf("Interrupt %d failed: %v", i+1, err)
+		}
+		msg := <-messages
+		if msg.Err != nil {
+			t.Fatalf("Received error: %v", msg.Err)
+		}
+		seen = append(seen, msg.Data["data"].(map[string]any)["request_id"].(string))
+	}
+
+	if seen[0] == seen[1] {
+		t.Errorf("Expected separate request IDs for separate interrupts, got %v", seen)
+	}
+}
+
+func TestSubprocessCLITransport_MaxPendingControl(t *testing.T) {
+	// Reads control requests without ever answering them
+	cliPath := writeFakeCLI(t, `cat >/dev/null
+sleep 0.2
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.MaxPendingControl = 1
+	trans := transport.NewSubprocessCLITransport(&testStream{}, options).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	messages := trans.ReceiveMessages(ctx)
+	defer func() {
+		trans.CloseInput()
+		for range messages {
+		}
+	}()
+
+	// Abandoned requests give up their slot
+	for i := 0; i < 3; i++ {
+		requestCtx, requestCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		err := trans.Interrupt(requestCtx)
+		requestCancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Interrupt %d: expected deadline exceeded, got %v", i+1, err)
+		}
+	}
+
+	// A request past the limit fails without waiting
+	pendingCtx, pendingCancel := context.WithCancel(ctx)
+	pending := make(chan error, 1)
+	go func() {
+		pending <- trans.Interrupt(pendingCtx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	var connErr *transport.CLIConnectionError
+	if err := trans.Interrupt(ctx); !errors.As(err, &connErr) || !strings.Contains(err.Error(), "pending control requests") {
+		t.Errorf("Expected pending control limit error, got %v", err)
+	}
+
+	pendingCancel()
+	if err := <-pending; !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected pending request to be canceled, got %v", err)
+	}
+}
+
+func TestSubprocessCLITransport_ControlTimeout(t *testing.T) {
+	// Reads control requests without ever answering them
+	cliPath := writeFakeCLI(t, `cat >/dev/null
+sleep 0.2
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.ControlTimeout = 200 * time.Millisecond
+	trans := transport.NewSubprocessCLITransport(&testStream{}, options).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+
+	messages := trans.ReceiveMessages(ctx)
+	defer func() {
+		trans.CloseInput()
+		for range messages {
+		}
+	}()
+
+	start := time.Now()
+	err := trans.Interrupt(context.Background())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("Expected the interrupt to give up after ControlTimeout, took %v", elapsed)
+	}
+}
+
+func TestSubprocessCLITransport_MarshalMessage(t *testing.T) {
+	// Echoes every message it receives back as output
+	cliPath := writeFakeCLI(t, `cat
+sleep 0.2
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.MarshalMessage = func(msg map[string]any) ([]byte, error) {
+		msg["proxy_route"] = "eu-1"
+		return json.Marshal(msg)
+	}
+	trans := transport.NewSubprocessCLITransport(&testStream{}, options).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	messages := trans.ReceiveMessages(ctx)
+
+	message := map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "hi"}}
+	if err := trans.SendRequest(ctx, []map[string]any{message}, nil); err != nil {
+		t.Fatalf("SendRequest failed: %v", err)
+	}
+	trans.CloseInput()
+
+	var routes []any
+	for msg := range messages {
+		if msg.Err != nil {
+			t.Fatalf("Received error: %v", msg.Err)
+		}
+		routes = append(routes, msg.Data["proxy_route"])
+	}
+	if len(routes) != 1 || routes[0] != "eu-1" {
+		t.Errorf("Expected the injected field on the wire, got %v", routes)
+	}
+}
+
+func TestSubprocessCLITransport_Metadata(t *testing.T) {
+	// Echoes every message it receives back as output, keeping a copy
+	input := filepath.Join(t.TempDir(), "input")
+	cliPath := writeFakeCLI(t, `tee '`+input+`'
+sleep 0.2
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.Metadata = map[string]string{"request_id": "req-42"}
+	prompt := &testStream{messages: []map[string]any{
+		{"type": "user", "message": map[string]any{"role": "user", "content": "first"}},
+	}}
+	trans := transport.NewSubprocessCLITransport(prompt, options).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	messages := trans.ReceiveMessages(ctx)
+
+	// Wait for the prompt so the order of the echoes is known
+	first := <-messages
+	if first.Err != nil || first.Data["message"].(map[string]any)["content"] != "first" {
+		t.Fatalf("Expected the prompt echoed first, got %+v", first)
+	}
+	metadata, _ := first.Data["metadata"].(map[string]any)
+	ids := []any{metadata["request_id"]}
+
+	message := map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "second"}}
+	own := map[string]any{"type": "user", "message": map[string]any{"role": "user", "content": "third"}, "metadata": map[string]any{"request_id": "own"}}
+	response := map[string]any{"type": "control_response", "response": map[string]any{"subtype": "success", "request_id": "req_1"}}
+	if err := trans.SendRequest(ctx, []map[string]any{message, own, response}, nil); err != nil {
+		t.Fatalf("SendRequest failed: %v", err)
+	}
+	trans.CloseInput()
+	if _, ok := message["metadata"]; ok {
+		t.Error("Expected the caller's message not to be modified")
+	}
+
+	for msg := range messages {
+		if msg.Err != nil {
+			t.Fatalf("Received error: %v", msg.Err)
+		}
+		metadata, _ := msg.Data["metadata"].(map[string]any)
+		ids = append(ids, metadata["request_id"])
+	}
+	if fmt.Sprint(ids) != "[req-42 req-42 own]" {
+		t.Errorf("Expected metadata on every user message unless already set, got %v", ids)
+	}
+
+	// Control responses are sent as they are
+	written, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatalf("Failed to read the CLI's input: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(written)), "\n")
+	if last := lines[len(lines)-1]; !strings.Contains(last, "control_response") || strings.Contains(last, "metadata") {
+		t.Errorf("Expected the control response without metadata, got %s", last)
+	}
+}
+
+func TestSubprocessCLITransport_SendRequestAtomic(t *testing.T) {
+	// Echoes every message it receives back as output
+	cliPath := writeFakeCLI(t, `cat
+sleep 0.2
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(&testStream{}, transport.NewOptions()).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	messages := trans.ReceiveMessages(ctx)
+
+	// Each batch must arrive as one contiguous run
+	type outcome struct {
+		runs  []string
+		count int
+		err   error
+	}
+	received := make(chan outcome, 1)
+	go func() {
+		var out outcome
+		for msg := range messages {
+			if msg.Err != nil {
+				out.err = msg.Err
+				continue
+			}
+			out.count++
+			batch := msg.Data["batch"].(string)
+			if len(out.runs) == 0 || out.runs[len(out.runs)-1] != batch {
+				out.runs = append(out.runs, batch)
+			}
+		}
+		received <- out
+	}()
+
+	const senders, batches, batchSize = 2, 5, 20
+	padding := strings.Repeat("x", 4096)
+	errs := make(chan error, senders)
+	for s := 0; s < senders; s++ {
+		go func(sender int) {
+			for b := 0; b < batches; b++ {
+				batch := make([]map[string]any, batchSize)
+				for i := range batch {
+					batch[i] = map[string]any{
+						"type":    "user",
+						"batch":   fmt.Sprintf("%d-%d", sender, b),
+						"message": map[string]any{"role": "user", "content": padding},
+					}
+				}
+				if err := trans.SendRequest(ctx, batch, nil); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(s)
+	}
+	for s := 0; s < senders; s++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("SendRequest failed: %v", err)
+		}
+	}
+	trans.CloseInput()
+
+	out := <-received
+	if out.err != nil {
+		t.Fatalf("Received error: %v", out.err)
+	}
+	runs, count := out.runs, out.count
+	if count != senders*batches*batchSize {
+		t.Fatalf("Expected %d messages, got %d", senders*batches*batchSize, count)
+	}
+	if len(runs) != senders*batches {
+		t.Errorf("Expected %d contiguous batches, got interleaved runs %v", senders*batches, runs)
+	}
+}
+
+func TestSubprocessCLITransport_SendRequestDeadline(t *testing.T) {
+	// The fake CLI stalls before reading stdin, then echoes every message
+	// it receives back as output
+	cliPath := writeFakeCLI(t, `sleep 1
+cat
+sleep 0.2
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	trans := transport.NewSubprocessCLITransport(&testStream{}, transport.NewOptions()).
+		WithStreaming(true).
+		WithCLIPath(cliPath)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	messages := trans.ReceiveMessages(ctx)
+
+	userMessage := func(content string) []map[string]any {
+		return []map[string]any{{"type": "user", "message": map[string]any{"role": "user", "content": content}}}
+	}
+
+	// Fill the pipe so later writes block until the CLI starts reading
+	firstDone := make(chan error, 1)
+	go func() {
+		firstDone <- trans.SendRequest(ctx, userMessage(strings.Repeat("x", 256*1024)), nil)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	sendCtx, sendCancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer sendCancel()
+	start := time.Now()
+	err := trans.SendRequest(sendCtx, userMessage("abandoned"), nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+		t.Errorf("Expected the send to give up at its deadline, took %v", elapsed)
+	}
+
+	if err := <-firstDone; err != nil {
+		t.Fatalf("First send failed: %v", err)
+	}
+	if err := trans.SendRequest(ctx, userMessage("last"), nil); err != nil {
+		t.Fatalf("Send after the stall failed: %v", err)
+	}
+	trans.CloseInput()
+
+	var echoed []string
+	for msg := range messages {
+		if msg.Err != nil {
+			t.Fatalf("Received error: %v", msg.Err)
+		}
+		content := msg.Data["message"].(map[string]any)["content"].(string)
+		echoed = append(echoed, content[:min(len(content), 10)])
+	}
+	if len(echoed) != 2 || echoed[1] != "last" {
+		t.Errorf("Expected the abandoned message to be skipped, got %v", echoed)
+	}
+}
+
+func TestSubprocessCLITransport_AutoAdjustFlags(t *testing.T) {
+	// The fake CLI rejects --verbose like an older CLI would, and otherwise
+	// reports its arguments. Each start is logged.
+	starts := filepath.Join(t.TempDir(), "starts")
+	cliPath := writeFakeCLI(t, `echo start >> '`+starts+`'
+case " $* " in
+  *" --verbose "*) echo "error: unknown option '--verbose'" >&2; exit 1 ;;
+esac
+printf '{"type":"system","subtype":"args","data":{"args":"%s"}}\n' "$*"
+sleep 0.2
+`)
+	countStarts := func() int {
+		data, _ := os.ReadFile(starts)
+		return strings.Count(string(data), "start")
+	}
+
+	// The second adjusted run reuses what the first found
+	for i, autoAdjust := range []bool{false, true, true} {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		before := countStarts()
+
+		options := transport.NewOptions()
+		options.AutoAdjustFlags = autoAdjust
+		trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+			WithCLIPath(cliPath)
+		if err := trans.Connect(ctx); err != nil {
+			cancel()
+			t.Fatalf("Failed to connect: %v", err)
+		}
+
+		var args string
+		var processErr *transport.ProcessError
+		for msg := range trans.ReceiveMessages(ctx) {
+			if msg.Err != nil {
+				if !errors.As(msg.Err, &processErr) {
+					t.Errorf("Expected ProcessError, got %v", msg.Err)
+				}
+				continue
+			}
+			args = msg.Data["data"].(map[string]any)["args"].(string)
+		}
+		trans.Disconnect()
+		cancel()
+
+		wantStarts := 1
+		if i == 1 {
+			wantStarts = 2
+		}
+		if got := countStarts() - before; got != wantStarts {
+			t.Errorf("Run %d: expected %d starts of the CLI, got %d", i, wantStarts, got)
+		}
+		if !autoAdjust {
+			if processErr == nil || !strings.Contains(processErr.Stderr, "unknown option") {
+				t.Errorf("Expected the unknown flag failure without AutoAdjustFlags, got %v", processErr)
+			}
+			continue
+		}
+		if processErr != nil {
+			t.Errorf("Run %d: expected no failure with AutoAdjustFlags, got %v", i, processErr)
+		}
+		if args == "" || strings.Contains(args, "--verbose") || !strings.Contains(args, "--print test") {
+			t.Errorf("Run %d: expected the command to omit only --verbose, got %q", i, args)
+		}
+	}
+}
+
+func TestSubprocessCLITransport_AutoAdjustFlagsUnlocked(t *testing.T) {
+	// Takes a while to write anything, so the check waits
+	cliPath := writeFakeCLI(t, `sleep 1
+printf '{"type":"system","subtype":"ready"}\n'
+sleep 0.2
+`)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	options := transport.NewOptions()
+	options.AutoAdjustFlags = true
+	trans := transport.NewSubprocessCLITransport(transport.NewStringPromptStream("test"), options).
+		WithCLIPath(cliPath)
+	connected := make(chan error, 1)
+	go func() {
+		connected <- trans.Connect(ctx)
+	}()
+	defer trans.Disconnect()
+
+	// The transport answers while Connect checks the flags
+	time.Sleep(200 * time.Millisecond)
+	answered := make(chan bool, 1)
+	go func() {
+		answered <- trans.IsConnected()
+	}()
+	select {
+	case isConnected := <-answered:
+		if isConnected {
+			t.Error("Expected IsConnected to be false while checking flags")
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("Expected IsConnected not to wait for the flag check")
+	}
+	if err := trans.Connect(ctx); err == nil {
+		t.Error("Expected a concurrent Connect to fail while checking flags")
+	}
+
+	if err := <-connected; err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	msg := <-trans.ReceiveMessages(ctx)
+	if msg.Err != nil || msg.Data["subtype"] != "ready" {
+		t.Errorf("Expected the CLI's output after the check, got %+v", msg)
+	}
+}
+
+// controlEchoScript is a fake CLI that acknowledges every control request
+// and reports the request ID it saw as a system message
+const controlEchoScript = `while read -r line; do
+  id=$(printf '%s' "$line" | sed -n 's/.*"request_id":"\([^"]*\)".*/\1/p')
+  if [ -n "$id" ]; then
+    printf '{"type":"control_response","response":{"request_id":"%s","subtype":"success"}}\n' "$id"
+    printf '{"type":"system","subtype":"control_seen","data":{"request_id":"%s"}}\n' "$id"
+  fi
+done
+`
+
+
+func TestSubprocessCLITransport_RapidConnectDisconnect(t *testing.T) {
+	// Alternate between a CLI that exits at once, racing Disconnect, and
+	// one that runs until its input is closed
+	scripts := []string{
+		writeFakeCLI(t, `echo '{"type":"system","subtype":"init"}'
+`),
+		writeFakeCLI(t, `echo '{"type":"system","subtype":"init"}'
+cat >/dev/null
+`),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for i := 0; i < 20; i++ {
+		trans := transport.NewSubprocessCLITransport(&testStream{}, transport.NewOptions()).
+			WithStreaming(true).
+			WithCLIPath(scripts[i%len(scripts)])
+		if err := trans.Connect(ctx); err != nil {
+			t.Fatalf("Connect %d failed: %v", i, err)
+		}
+		messages := trans.ReceiveMessages(ctx)
+
+		if err := trans.Disconnect(); err != nil {
+			t.Fatalf("Disconnect %d failed: %v", i, err)
+		}
+
+		// The output channel is closed exactly once after Disconnect
+		closed := make(chan struct{})
+		go func() {
+			for range messages {
+			}
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Output channel %d not closed after Disconnect", i)
+		}
+		if trans.IsConnected() {
+			t.Errorf("Expected transport %d to be disconnected", i)
+		}
+	}
+}
+
+func TestSubprocessCLITransport_StderrTimeout(t *testing.T) {
+	// The fake CLI writes to stderr and keeps it open until its input is
+	// closed, then fails
+	cliPath := writeFakeCLI(t, `echo "boom" >&2
+cat >/dev/null
+exit 3
+`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	clock := newFakeClock()
+	trans := transport.NewSubprocessCLITransport(&testStream{}, transport.NewOptions()).
+		WithStreaming(true).
+		WithCLIPath(cliPath).
+		SetClock(clock)
+	if err := trans.Connect(ctx); err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer trans.Disconnect()
+	messages := trans.ReceiveMessages(ctx)
+
+	// Fire the stderr timeout while the process is still running
+	select {
+	case d := <-clock.waiting:
+		if d != 30*time.Second {
+			t.Fatalf("Expected the stderr timeout to be waited on, got %v", d)
+		}
+	case <-ctx.Done():
+		t.Fatal("Stderr timeout was never started")
+	}
+	clock.Advance(30 * time.Second)
+	trans.CloseInput()
+
+	var processErr *transport.ProcessError
+	for msg := range messages {
+		if msg.Err != nil && !errors.As(msg.Err, &processErr) {
+			t.Errorf("Unexpected error: %v", msg.Err)
+		}
+	}
+	if processErr == nil {
+		t.Fatal("Expected a ProcessError for the failed CLI")
+	}
+	if processErr.ExitCode != 3 {
+		t.Errorf("Expected exit code 3, got %d", processErr.ExitCode)
+	}
+	if !strings.HasSuffix(processErr.Stderr, "[stderr collection timed out after 30s]") {
+		t.Errorf("Expected the stderr timeout to be noted, got %q", processErr.Stderr)
+	}
+}
+// writeFakeCLI writes an executable shell script standing in for the CLI
+func writeFakeCLI(t *testing.T, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("Fake CLI scripts require a POSIX shell")
+	}
+
+	path := filepath.Join(t.TempDir(), "claude")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatalf("Failed to write fake CLI: %v", err)
+	}
+	return path
+}
+
+// testStream implements MessageStream for testing
+type testStream struct {
+	messages []map[string]any
+	index    int
+}
+
+func (s *testStream) Next(ctx context.Context) (map[string]any, error) {
+	if s.index >= len(s.messages) {
+		return nil, nil // EOF
+	}
+	msg := s.messages[s.index]
+	s.index++
+	return msg, nil
+}
+// fakeClock is a transport.Clock whose time only moves when advanced.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []fakeTimer
+	tickers []*fakeTicker
+	waiting chan time.Duration // receives the duration of each After call
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), waiting: make(chan time.Duration, 100)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// After returns an unbuffered channel, so Advance returns only once the
+// timeout has been received.
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	timer := fakeTimer{deadline: c.now.Add(d), c: make(chan time.Time)}
+	c.timers = append(c.timers, timer)
+	c.waiting <- d
+	return timer.c
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) transport.Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := &fakeTicker{period: d, next: c.now.Add(d), c: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, ticker)
+	return ticker
+}
+
+// Advance moves the clock forward, firing the timers and tickers due.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var due []fakeTimer
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.deadline.After(now) {
+			pending = append(pending, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	c.timers = pending
+	for _, ticker := range c.tickers {
+		if !ticker.stopped.Load() && !ticker.next.After(now) {
+			ticker.next = now.Add(ticker.period)
+			select {
+			case ticker.c <- now:
+			default:
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	for _, timer := range due {
+		timer.c <- now
+	}
+}
+
+type fakeTicker struct {
+	period  time.Duration
+	next    time.Time
+	c       chan time.Time
+	stopped atomic.Bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+func (t *fakeTicker) Stop()               { t.stopped.Store(true) }
@@ -18,9 +18,16 @@ type Transport interface {
 	// SendRequest sends additional messages (only works in streaming mode).
 	SendRequest(ctx context.Context, messages []map[string]any, metadata map[string]any) error
 	
+	// CloseInput closes the input side of the connection while leaving
+	// the output side open.
+	CloseInput() error
+	
 	// Interrupt sends an interrupt signal.
 	Interrupt(ctx context.Context) error
 	
 	// IsConnected checks if the transport is connected.
 	IsConnected() bool
+	
+	// IsStreaming checks if the transport runs in streaming mode.
+	IsStreaming() bool
 }
\ No newline at end of file
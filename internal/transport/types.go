@@ -1,6 +1,12 @@
 package transport
 
-import "context"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
 
 // MessageStream represents a stream of messages
 type MessageStream interface {
@@ -16,6 +22,13 @@ type Options struct {
 	// SystemPrompt is the initial system message
 	SystemPrompt string
 	
+	// SystemPromptParts are joined after SystemPrompt into the system prompt
+	SystemPromptParts []string
+	
+	// SystemPromptSeparator separates the system prompt fragments
+	// (defaults to a blank line)
+	SystemPromptSeparator string
+	
 	// AppendSystemPrompt appends additional text to the system prompt
 	AppendSystemPrompt string
 	
@@ -45,6 +58,182 @@ type Options struct {
 	
 	// MCP server configurations
 	MCPServers map[string]any
+	
+	// Treat any stderr output as a process error, even on a zero exit code
+	TreatStderrAsError bool
+	
+	// Prefix for generated control request IDs (defaults to "req")
+	RequestIDPrefix string
+	
+	// Log every raw stdout line and its parse outcome via the log package
+	DebugRawOutput bool
+	
+	// Extra environment variables for the subprocess
+	Env map[string]string
+	
+	// Start the subprocess with only Env, without inheriting os.Environ()
+	CleanEnv bool
+	
+	// Times to resend an unacknowledged interrupt in streaming mode
+	InterruptRetries int
+	
+	// Start the CLI again without optional flags it rejects at startup.
+	// The first Connect for each CLI path waits up to 2s for the CLI to
+	// get past its argument checks; later ones reuse the result
+	AutoAdjustFlags bool
+	
+	// Emit streaming events (stream_event messages) as they arrive
+	IncludePartialMessages bool
+	
+	// Max output tokens per response, passed as CLAUDE_CODE_MAX_OUTPUT_TOKENS
+	MaxTokens *int
+	
+	// Max control requests awaiting a response (defaults to 256)
+	MaxPendingControl int
+	
+	// Locates the CLI instead of FindCLI when no CLI path is set
+	CLILocator func() (string, error)
+	
+	// Run every tool without permission checks (--dangerously-skip-permissions)
+	SkipAllPermissions bool
+	
+	// Memory and CPU limits for the subprocess (Linux only)
+	ResourceLimits *ResourceLimits
+	
+	// Time to wait for a control response when the caller's context has
+	// no deadline (defaults to 10s)
+	ControlTimeout time.Duration
+	
+	// Encodes outbound stdin messages instead of json.Marshal; the output
+	// must be a single line of JSON
+	MarshalMessage func(map[string]any) ([]byte, error)
+	
+	// Kill the process if it writes nothing to stdout within this time
+	// of starting, or in streaming mode of the first stdin write
+	FirstMessageTimeout time.Duration
+	
+	// Settings passed to the CLI as JSON with --settings
+	Settings map[string]any
+	// Added as "metadata" to user messages on stdin that don't carry their own
+	// Added as "metadata" to stdin messages that don't carry their own
+	Metadata map[string]string
+	
+	// Buffered message count above which OnBackpressure is called (0 disables)
+	BufferHighWaterMark int
+	
+	// Called from the reader goroutine when the buffer rises above
+	// BufferHighWaterMark; it must not block
+	OnBackpressure func(pending int)
+	
+	// Directory for temp files, such as a large system prompt (defaults to
+	// os.TempDir())
+	TempDir string
+	
+	// Called with ControlSent or ControlReceived for every control request
+	// and response written to or read from the CLI
+	OnControl func(direction byte, payload map[string]any)
+}
+
+// ResourceLimits caps the resources of the CLI process. Zero fields are
+// unlimited.
+type ResourceLimits struct {
+	MaxMemoryBytes uint64        // address space, rounded down to KiB
+	MaxCPUTime     time.Duration // CPU time, rounded up to whole seconds
+}
+
+// ToolArgs returns the --allowedTools and --disallowedTools flags for the
+// options.
+func (o *Options) ToolArgs() []string {
+	return append(toolsArg("--allowedTools", o.AllowedTools), toolsArg("--disallowedTools", o.DisallowedTools)...)
+}
+
+// toolsArg returns flag with the comma-separated tools, or nothing if there
+// are none.
+func toolsArg(flag string, tools []string) []string {
+	if len(tools) == 0 {
+		return nil
+	}
+	return []string{flag, strings.Join(tools, ",")}
+}
+
+// Args returns the CLI flags for the options, excluding the prompt flags
+// (--print or --input-format) that depend on the prompt mode.
+func (o *Options) Args() []string {
+	cmd := []string{"--output-format", "stream-json", "--verbose"}
+
+	if systemPrompt := o.systemPrompt(); systemPrompt != "" {
+		cmd = append(cmd, "--system-prompt", systemPrompt)
+	}
+
+	if o.AppendSystemPrompt != "" {
+		cmd = append(cmd, "--append-system-prompt", o.AppendSystemPrompt)
+	}
+
+	cmd = append(cmd, toolsArg("--allowedTools", o.AllowedTools)...)
+
+	if o.MaxTurns != nil {
+		cmd = append(cmd, "--max-turns", fmt.Sprintf("%d", *o.MaxTurns))
+	}
+
+	cmd = append(cmd, toolsArg("--disallowedTools", o.DisallowedTools)...)
+
+	if o.Model != "" {
+		cmd = append(cmd, "--model", o.Model)
+	}
+
+	if o.PermissionPromptToolName != "" {
+		cmd = append(cmd, "--permission-prompt-tool", o.PermissionPromptToolName)
+	}
+
+	if o.PermissionMode != "" {
+		cmd = append(cmd, "--permission-mode", o.PermissionMode)
+	}
+
+	if o.SkipAllPermissions {
+		cmd = append(cmd, "--dangerously-skip-permissions")
+	}
+
+	if o.ContinueConversation {
+		cmd = append(cmd, "--continue")
+	}
+
+	if o.Resume != "" {
+		cmd = append(cmd, "--resume", o.Resume)
+	}
+
+	if o.IncludePartialMessages {
+		cmd = append(cmd, "--include-partial-messages")
+	}
+
+	if len(o.Settings) > 0 {
+		settingsJSON, _ := json.Marshal(o.Settings)
+		cmd = append(cmd, "--settings", string(settingsJSON))
+	}
+
+	if len(o.MCPServers) > 0 {
+		mcpConfig := map[string]any{"mcpServers": o.MCPServers}
+		configJSON, _ := json.Marshal(mcpConfig)
+		cmd = append(cmd, "--mcp-config", string(configJSON))
+	}
+
+	return cmd
+}
+
+// systemPrompt joins SystemPrompt and SystemPromptParts, skipping empty
+// fragments.
+func (o *Options) systemPrompt() string {
+	separator := o.SystemPromptSeparator
+	if separator == "" {
+		separator = "\n\n"
+	}
+
+	var fragments []string
+	for _, fragment := range append([]string{o.SystemPrompt}, o.SystemPromptParts...) {
+		if fragment != "" {
+			fragments = append(fragments, fragment)
+		}
+	}
+	return strings.Join(fragments, separator)
 }
 
 // NewOptions creates a new Options with defaults
@@ -0,0 +1,126 @@
+package claude
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RenderMarkdown formats a conversation as a human-readable markdown
+// transcript: user and assistant turns, tool uses with their inputs, tool
+// results, and a summary of turns, duration and cost from the result
+// messages. System and stream event messages are omitted.
+func RenderMarkdown(messages []Message) string {
+	var b strings.Builder
+	var results []*ResultMessage
+
+	for _, msg := range messages {
+		switch m := msg.(type) {
+		case *UserMessage:
+			b.WriteString("## User\n\n")
+			if len(m.Blocks) == 0 {
+				b.WriteString(m.Content + "\n\n")
+			}
+			for _, block := range m.Blocks {
+				renderBlock(&b, block)
+			}
+		case *AssistantMessage:
+			b.WriteString("## Assistant\n\n")
+			for _, block := range m.Content {
+				renderBlock(&b, block)
+			}
+		case *ResultMessage:
+			results = append(results, m)
+		}
+	}
+
+	if len(results) > 0 {
+		renderSummary(&b, results)
+	}
+	return strings.TrimRight(b.String(), "\n") + "\n"
+}
+
+// renderBlock writes a content block followed by a blank line.
+func renderBlock(b *strings.Builder, block ContentBlock) {
+	switch block := block.(type) {
+	case *TextBlock:
+		b.WriteString(block.Text + "\n\n")
+	case *ToolUseBlock:
+		input, _ := json.MarshalIndent(block.Input, "", "  ")
+		fmt.Fprintf(b, "**Tool use:** `%s` (`%s`)\n\n", block.Name, block.ID)
+		b.WriteString(codeFence(string(input), "json") + "\n\n")
+	case *ToolResultBlock:
+		label := "Tool result"
+		if block.IsError != nil && *block.IsError {
+			label = "Tool error"
+		}
+		fmt.Fprintf(b, "**%s:** `%s`\n\n", label, block.ToolUseID)
+		b.WriteString(codeFence(toolResultText(block), "") + "\n\n")
+	case *ImageBlock:
+		b.WriteString("_[image]_\n\n")
+	case *DocumentBlock:
+		name := block.Title
+		if name == "" {
+			name = block.Path
+		}
+		if name == "" {
+			b.WriteString("_[document]_\n\n")
+		} else {
+			fmt.Fprintf(b, "_[document: %s]_\n\n", name)
+		}
+	}
+}
+
+// toolResultText flattens tool result content to text, noting non-text
+// blocks by type.
+func toolResultText(block *ToolResultBlock) string {
+	var parts []string
+	for _, item := range toolResultContentBlocks(block.Content) {
+		data, _ := item.(map[string]any)
+		if text, ok := data["text"].(string); ok && data["type"] == "text" {
+			parts = append(parts, text)
+		} else {
+			parts = append(parts, fmt.Sprintf("[%v]", data["type"]))
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// renderSummary writes the totals across all result messages.
+func renderSummary(b *strings.Builder, results []*ResultMessage) {
+	var turns, durationMS int
+	var cost float64
+	var hasCost, failed bool
+	for _, result := range results {
+		turns += result.NumTurns
+		durationMS += result.DurationMS
+		if result.TotalCostUSD != nil {
+			cost += *result.TotalCostUSD
+			hasCost = true
+		}
+		failed = failed || result.IsError
+	}
+
+	status := "success"
+	if failed {
+		status = "error"
+	}
+
+	b.WriteString("---\n\n## Summary\n\n")
+	fmt.Fprintf(b, "- Status: %s\n", status)
+	fmt.Fprintf(b, "- Turns: %d\n", turns)
+	fmt.Fprintf(b, "- Duration: %.1fs\n", float64(durationMS)/1000)
+	if hasCost {
+		fmt.Fprintf(b, "- Cost: $%.4f\n", cost)
+	}
+}
+
+// codeFence wraps content in a fenced code block, using a fence longer than
+// any backtick run in the content.
+func codeFence(content, language string) string {
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	return fence + language + "\n" + content + "\n" + fence
+}
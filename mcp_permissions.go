@@ -0,0 +1,81 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/davlia/claude-code-sdk-go/internal/transport"
+)
+
+// MCPPermissionHandler decides whether an MCP tool may run. server and tool
+// are parsed from the CLI's "mcp__<server>__<tool>" tool name. Returning
+// an error fails the CLI's permission request.
+type MCPPermissionHandler func(server, tool string, input map[string]any) (bool, error)
+
+// handleControlRequest answers a control request sent by the CLI. Permission
+// prompts for MCP tools go to Options.MCPPermissionHandler; built-in tools
+// are denied, matching the CLI's non-interactive behavior.
+func (c *Client) handleControlRequest(ctx context.Context, trans transport.Transport, data map[string]any) error {
+	requestID, _ := data["request_id"].(string)
+	request, _ := data["request"].(map[string]any)
+
+	var response map[string]any
+	if subtype, _ := request["subtype"].(string); subtype == "can_use_tool" {
+		response = c.permissionResponse(request)
+	} else {
+		response = controlError(fmt.Sprintf("unsupported control request: %q", subtype))
+	}
+	response["request_id"] = requestID
+
+	message := map[string]any{"type": "control_response", "response": response}
+	return trans.SendRequest(ctx, []map[string]any{message}, nil)
+}
+
+// permissionResponse builds the response to a can_use_tool request.
+func (c *Client) permissionResponse(request map[string]any) map[string]any {
+	toolName, _ := request["tool_name"].(string)
+	input, _ := request["input"].(map[string]any)
+
+	server, tool, ok := parseMCPToolName(toolName)
+	handler := c.options.MCPPermissionHandler
+	if !ok || handler == nil {
+		return controlSuccess(map[string]any{
+			"behavior": "deny",
+			"message":  fmt.Sprintf("no permission handler for tool %s", toolName),
+		})
+	}
+
+	allowed, err := handler(server, tool, input)
+	if err != nil {
+		return controlError(err.Error())
+	}
+	if !allowed {
+		return controlSuccess(map[string]any{
+			"behavior": "deny",
+			"message":  fmt.Sprintf("permission denied for tool %s", toolName),
+		})
+	}
+	return controlSuccess(map[string]any{"behavior": "allow", "updatedInput": input})
+}
+
+// parseMCPToolName splits "mcp__<server>__<tool>" into its parts.
+func parseMCPToolName(name string) (server, tool string, ok bool) {
+	rest, found := strings.CutPrefix(name, "mcp__")
+	if !found {
+		return "", "", false
+	}
+	server, tool, found = strings.Cut(rest, "__")
+	if !found || server == "" || tool == "" {
+		return "", "", false
+	}
+	return server, tool, true
+}
+
+func controlSuccess(payload map[string]any) map[string]any {
+	return map[string]any{"subtype": "success", "response": payload}
+}
+
+func controlError(message string) map[string]any {
+	return map[string]any{"subtype": "error", "error": message}
+}
@@ -0,0 +1,84 @@
+package claude
+
+import "strings"
+
+// MessageBuilder builds user message envelopes in the shape the CLI expects
+// on stdin in streaming mode.
+type MessageBuilder struct {
+	sessionID string
+}
+
+// NewMessageBuilder creates a MessageBuilder for the given session.
+// An empty sessionID uses "default".
+func NewMessageBuilder(sessionID string) *MessageBuilder {
+	if sessionID == "" {
+		sessionID = "default"
+	}
+	return &MessageBuilder{sessionID: sessionID}
+}
+
+// UserText builds a plain text user message.
+func (b *MessageBuilder) UserText(text string) map[string]any {
+	return b.envelope(text, nil)
+}
+
+// SlashCommand builds a user message invoking a CLI slash command such as
+// "/compact". The leading slash on cmd is optional; args, if any, follow
+// the command separated by a space.
+func (b *MessageBuilder) SlashCommand(cmd string, args string) map[string]any {
+	text := "/" + strings.TrimPrefix(cmd, "/")
+	if args != "" {
+		text += " " + args
+	}
+	return b.UserText(text)
+}
+
+// UserDocument builds a user message carrying doc, followed by text such as
+// a question about the document. An empty text sends the document alone.
+func (b *MessageBuilder) UserDocument(doc DocumentBlock, text string) map[string]any {
+	content := []any{doc.toWire()}
+	if text != "" {
+		content = append(content, map[string]any{"type": "text", "text": text})
+	}
+	return b.envelope(content, nil)
+}
+
+// ToolResult builds a user message replying to a tool use. The envelope's
+// parent_tool_use_id links it to the originating tool use.
+//
+// Content may be a string or a slice of content block maps.
+func (b *MessageBuilder) ToolResult(toolUseID string, content any) map[string]any {
+	return b.ToolResultBlock(ToolResultBlock{ToolUseID: toolUseID, Content: content})
+}
+
+// ToolResultAndText builds a user message replying to a tool use and
+// following the result with a text instruction in the same turn.
+func (b *MessageBuilder) ToolResultAndText(toolUseID string, content any, text string) map[string]any {
+	block := ToolResultBlock{ToolUseID: toolUseID, Content: content}
+	return b.envelope([]any{
+		block.toWire(),
+		map[string]any{"type": "text", "text": text},
+	}, toolUseID)
+}
+
+// ToolResultBlock builds a user message carrying block, e.g. a tool result
+// received earlier or one with IsError set.
+func (b *MessageBuilder) ToolResultBlock(block ToolResultBlock) map[string]any {
+	return block.toEnvelope(b.sessionID)
+}
+
+// envelope wraps message content in a user message envelope.
+func (b *MessageBuilder) envelope(content any, parentToolUseID any) map[string]any {
+	if id, ok := parentToolUseID.(string); ok && id == "" {
+		parentToolUseID = nil
+	}
+	return map[string]any{
+		"type": "user",
+		"message": map[string]any{
+			"role":    "user",
+			"content": content,
+		},
+		"parent_tool_use_id": parentToolUseID,
+		"session_id":         b.sessionID,
+	}
+}
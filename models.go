@@ -0,0 +1,50 @@
+package claude
+
+import (
+	"fmt"
+	"path"
+)
+
+// KnownModels is the set of model names accepted when Options.ValidateModel
+// is set: the CLI's aliases and current full model names. Add entries,
+// e.g. for models released after this version of the SDK, before
+// connecting; it must not be modified while clients are connecting.
+var KnownModels = map[string]bool{
+	"sonnet":                     true,
+	"opus":                       true,
+	"haiku":                      true,
+	"claude-opus-4-1-20250805":   true,
+	"claude-opus-4-20250514":     true,
+	"claude-sonnet-4-20250514":   true,
+	"claude-3-7-sonnet-20250219": true,
+	"claude-3-5-sonnet-20241022": true,
+	"claude-3-5-haiku-20241022":  true,
+}
+
+// KnownModelPatterns holds path.Match patterns, such as
+// "claude-sonnet-4-*", for model names accepted besides KnownModels. It is
+// empty by default.
+var KnownModelPatterns []string
+
+// isKnownModel reports whether model is in KnownModels or matches one of
+// KnownModelPatterns.
+func isKnownModel(model string) bool {
+	if KnownModels[model] {
+		return true
+	}
+	for _, pattern := range KnownModelPatterns {
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validateModel checks Model against the known models when
+// Options.ValidateModel is set.
+func (o *Options) validateModel() error {
+	if !o.ValidateModel || o.Model == "" || isKnownModel(o.Model) {
+		return nil
+	}
+	return &SDKError{message: fmt.Sprintf("unknown model %q; add it to KnownModels or KnownModelPatterns if it is valid", o.Model)}
+}
@@ -1,12 +1,20 @@
 package claude
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/davlia/claude-code-sdk-go/internal/transport"
+)
 
 // Options represents the configuration for a Claude Code client.
 type Options struct {
 	AllowedTools             []string                   `json:"allowed_tools,omitempty"`
 	MaxThinkingTokens        int                        `json:"max_thinking_tokens,omitempty"`
 	SystemPrompt             string                     `json:"system_prompt,omitempty"`
+	SystemPromptParts        []string                   `json:"system_prompt_parts,omitempty"`     // joined after SystemPrompt into the system prompt
+	SystemPromptSeparator    string                     `json:"system_prompt_separator,omitempty"` // between parts, defaults to a blank line
 	AppendSystemPrompt       string                     `json:"append_system_prompt,omitempty"`
 	MCPTools                 []string                   `json:"mcp_tools,omitempty"`
 	MCPServers               map[string]MCPServerConfig `json:"mcp_servers,omitempty"`
@@ -18,20 +26,344 @@ type Options struct {
 	Model                    string                     `json:"model,omitempty"`
 	PermissionPromptToolName string                     `json:"permission_prompt_tool_name,omitempty"`
 	Cwd                      string                     `json:"cwd,omitempty"`
+	TreatStderrAsError       bool                       `json:"treat_stderr_as_error,omitempty"`
+	RequestIDPrefix          string                     `json:"request_id_prefix,omitempty"`
+	MaxMessages              int                        `json:"max_messages,omitempty"`
+	DebugRawOutput           bool                       `json:"debug_raw_output,omitempty"`
+	ToolPolicy               *ToolPolicy                `json:"tool_policy,omitempty"`              // overrides AllowedTools and DisallowedTools when set
+	MaxConcurrency           int                        `json:"max_concurrency,omitempty"`          // concurrent queries in Batch, 0 for unlimited
+	Env                      map[string]string          `json:"env,omitempty"`                      // extra environment variables for the CLI process
+	CleanEnv                 bool                       `json:"clean_env,omitempty"`                // don't inherit the parent environment, use only Env
+	InterruptRetries         int                        `json:"interrupt_retries,omitempty"`        // resends of an unacknowledged interrupt
+	AutoAdjustFlags          bool                       `json:"auto_adjust_flags,omitempty"`        // restart the CLI without --verbose if it rejects the flag
+	IncludePartialMessages   bool                       `json:"include_partial_messages,omitempty"` // deliver streaming events as StreamEvent messages
+	MCPPermissionHandler     MCPPermissionHandler       `json:"-"`                                  // answers permission prompts for MCP tools; requires streaming
+	MaxTokens                *int                       `json:"max_tokens,omitempty"`               // response token limit, via CLAUDE_CODE_MAX_OUTPUT_TOKENS
+	StopPredicate            func(Message) bool         `json:"-"`                                  // interrupts and ends ReceiveMessages when it returns true
+	MaxPendingControl        int                        `json:"max_pending_control,omitempty"`      // control requests awaiting a response, 0 for the default of 256
+	CLILocator               func() (string, error)     `json:"-"`                                  // finds the CLI executable instead of the built-in search
+	ControlTimeout           time.Duration              `json:"control_timeout,omitempty"`          // wait for control responses without a ctx deadline, 0 for 10s
+	MarshalMessage           MessageMarshaler           `json:"-"`                                  // encodes messages sent to the CLI; json.Marshal by default
+	FirstMessageTimeout      time.Duration              `json:"first_message_timeout,omitempty"`    // kill the CLI if it has written nothing by then; when streaming, timed from the first message sent
+	MaxPromptTokens          int                        `json:"max_prompt_tokens,omitempty"`        // reject string prompts estimated larger, see EstimateTokens
+	ResultStopSubtypes       []string                   `json:"result_stop_subtypes,omitempty"`     // result subtypes that end a response, empty for any result
+	EchoPrompts              bool                       `json:"echo_prompts,omitempty"`             // deliver messages sent by the Client as UserMessages through ReceiveMessages
+	Metadata                 map[string]string          `json:"metadata,omitempty"`                 // attached to user messages sent to the CLI and reported on ResultMessage.Metadata
+	ValidateModel            bool                       `json:"validate_model,omitempty"`           // reject a Model not in KnownModels before starting the CLI
+	Heartbeat                time.Duration              `json:"heartbeat,omitempty"`                // deliver a "ping" SystemMessage after this long without output; 0 drops the CLI's pings
+	BufferHighWaterMark      int                        `json:"buffer_high_water_mark,omitempty"`   // buffered messages above which OnBackpressure is called, 0 to disable
+	OnBackpressure           func(pending int)          `json:"-"`                                  // called without blocking when the buffer rises above BufferHighWaterMark
+	TempDir                  string                     `json:"temp_dir,omitempty"`                 // directory for temp files such as a large system prompt, removed on Disconnect; os.TempDir() by default
+	SeedMessages             []Message                  `json:"-"`                                  // user and assistant turns sent before the prompt, e.g. few-shot examples; streams a string prompt
+	ReconnectBackoff         BackoffStrategy            `json:"-"`                                  // delay before QueryWithRetry starts the CLI again when its RetryPolicy has no Backoff
+
+	// CompressInput requests gzip-compressed stdin for large streaming
+	// inputs. The CLI currently accepts only plain text and stream-json
+	// input, so Validate rejects it; input is always sent uncompressed.
+	CompressInput bool `json:"compress_input,omitempty"`
+
+	// SkipAllPermissions passes --dangerously-skip-permissions, so the CLI
+	// runs every tool, including Bash and file edits, without asking.
+	// WARNING: only use it in a sandbox with no internet access; the model
+	// can do anything the process can. It can't be combined with
+	// PermissionPromptToolName or MCPPermissionHandler.
+	SkipAllPermissions bool `json:"skip_all_permissions,omitempty"`
+
+	// ResourceLimits caps the memory and CPU time of the CLI process and
+	// anything it runs, such as Bash tool commands. It is supported on
+	// Linux, where the limits are set with prlimit(2) as soon as the CLI
+	// has started; elsewhere it is ignored.
+	ResourceLimits *ResourceLimits `json:"resource_limits,omitempty"`
+
+	// ToolConfig holds tool-specific settings, passed to the CLI as JSON
+	// with --settings in the CLI's settings shape. For example, to let Bash
+	// run only git commands:
+	//
+	//	options.ToolConfig = map[string]any{
+	//	    "permissions": map[string]any{"allow": []string{"Bash(git:*)"}},
+	//	}
+	//
+	// Validate checks that it can be encoded as JSON.
+	ToolConfig map[string]any `json:"tool_config,omitempty"`
+
+	// OnControl is called with ControlSent or ControlReceived for every
+	// control request and response exchanged with the CLI, such as an
+	// interrupt and its acknowledgement, for debugging the control
+	// protocol. It is called from the goroutine that sends or reads the
+	// message, so it must not block.
+	OnControl func(direction byte, payload map[string]any) `json:"-"`
 }
 
-// NewOptions creates Options with default values.
+// ResourceLimits limits the resources of the CLI process. Zero fields are
+// unlimited.
+type ResourceLimits struct {
+	MaxMemoryBytes uint64        `json:"max_memory_bytes,omitempty"` // virtual address space, rounded down to KiB
+	MaxCPUTime     time.Duration `json:"max_cpu_time,omitempty"`     // CPU time, rounded up to whole seconds
+}
+
+// MessageMarshaler encodes a message envelope sent to the CLI on stdin, for
+// integrations that need to add fields or adapt the schema. The output must
+// be a single line of JSON.
+type MessageMarshaler func(msg map[string]any) ([]byte, error)
+
+// NewOptions creates Options with default values. The tool lists are left
+// nil, i.e. unset, see MarshalJSON.
 func NewOptions() *Options {
 	return &Options{
 		MaxThinkingTokens: 8000,
-		AllowedTools:      []string{},
-		MCPTools:          []string{},
 		MCPServers:        make(map[string]MCPServerConfig),
-		DisallowedTools:   []string{},
 	}
 }
 
+// Clone returns a copy of the options that can be modified without
+// affecting the original. Slices, maps and pointer fields are copied.
+func (o *Options) Clone() *Options {
+	clone := *o
+
+	if o.AllowedTools != nil {
+		clone.AllowedTools = append([]string{}, o.AllowedTools...)
+	}
+	if o.SystemPromptParts != nil {
+		clone.SystemPromptParts = append([]string{}, o.SystemPromptParts...)
+	}
+	if o.ResultStopSubtypes != nil {
+		clone.ResultStopSubtypes = append([]string{}, o.ResultStopSubtypes...)
+	}
+	if o.MCPTools != nil {
+		clone.MCPTools = append([]string{}, o.MCPTools...)
+	}
+	if o.DisallowedTools != nil {
+		clone.DisallowedTools = append([]string{}, o.DisallowedTools...)
+	}
+	if o.MCPServers != nil {
+		clone.MCPServers = make(map[string]MCPServerConfig, len(o.MCPServers))
+		for name, config := range o.MCPServers {
+			clone.MCPServers[name] = config
+		}
+	}
+	if o.Env != nil {
+		clone.Env = make(map[string]string, len(o.Env))
+		for key, value := range o.Env {
+			clone.Env[key] = value
+		}
+	}
+	if o.SeedMessages != nil {
+		clone.SeedMessages = append([]Message{}, o.SeedMessages...)
+	}
+	if o.Metadata != nil {
+		clone.Metadata = make(map[string]string, len(o.Metadata))
+		for key, value := range o.Metadata {
+			clone.Metadata[key] = value
+		}
+	}
+	if o.ToolConfig != nil {
+		clone.ToolConfig = make(map[string]any, len(o.ToolConfig))
+		for key, value := range o.ToolConfig {
+			clone.ToolConfig[key] = value
+		}
+	}
+	if o.MaxTurns != nil {
+		maxTurns := *o.MaxTurns
+		clone.MaxTurns = &maxTurns
+	}
+	if o.MaxTokens != nil {
+		maxTokens := *o.MaxTokens
+		clone.MaxTokens = &maxTokens
+	}
+	if o.ResourceLimits != nil {
+		limits := *o.ResourceLimits
+		clone.ResourceLimits = &limits
+	}
+	if o.ToolPolicy != nil {
+		policy := *o.ToolPolicy
+		policy.Allow = append([]string(nil), o.ToolPolicy.Allow...)
+		policy.Deny = append([]string(nil), o.ToolPolicy.Deny...)
+		clone.ToolPolicy = &policy
+	}
+
+	return &clone
+}
+
+// endsResponse reports whether msg completes a response: any ResultMessage,
+// or with ResultStopSubtypes set, only results with one of those subtypes.
+func (o *Options) endsResponse(msg Message) bool {
+	result, ok := msg.(*ResultMessage)
+	if !ok {
+		return false
+	}
+	if len(o.ResultStopSubtypes) == 0 {
+		return true
+	}
+	for _, subtype := range o.ResultStopSubtypes {
+		if result.Subtype == subtype {
+			return true
+		}
+	}
+	return false
+}
+
+// ToArgs returns the CLI flags these options produce, without the CLI path
+// and the prompt flags (--print or --input-format), which depend on how the
+// query is sent. It is the same list the transport passes to the CLI.
+func (o *Options) ToArgs() []string {
+	return o.toTransportOptions().Args()
+}
+
+// toTransportOptions converts the options to their transport counterpart.
+func (o *Options) toTransportOptions() *transport.Options {
+	transportOptions := &transport.Options{
+		Model:                    o.Model,
+		SystemPrompt:             o.SystemPrompt,
+		SystemPromptParts:        o.SystemPromptParts,
+		SystemPromptSeparator:    o.SystemPromptSeparator,
+		AppendSystemPrompt:       o.AppendSystemPrompt,
+		Cwd:                      o.Cwd,
+		AllowedTools:             o.AllowedTools,
+		DisallowedTools:          o.DisallowedTools,
+		MaxTurns:                 o.MaxTurns,
+		PermissionPromptToolName: o.PermissionPromptToolName,
+		PermissionMode:           string(o.PermissionMode),
+		ContinueConversation:     o.ContinueConversation,
+		Resume:                   o.Resume,
+		TreatStderrAsError:       o.TreatStderrAsError,
+		RequestIDPrefix:          o.RequestIDPrefix,
+		DebugRawOutput:           o.DebugRawOutput,
+		Env:                      o.Env,
+		CleanEnv:                 o.CleanEnv,
+		InterruptRetries:         o.InterruptRetries,
+		AutoAdjustFlags:          o.AutoAdjustFlags,
+		IncludePartialMessages:   o.IncludePartialMessages,
+		MaxTokens:                o.MaxTokens,
+		MaxPendingControl:        o.MaxPendingControl,
+		CLILocator:               o.CLILocator,
+		ControlTimeout:           o.ControlTimeout,
+		MarshalMessage:           o.MarshalMessage,
+		Settings:                 o.ToolConfig,
+		FirstMessageTimeout:      o.FirstMessageTimeout,
+		SkipAllPermissions:       o.SkipAllPermissions,
+		Metadata:                 o.Metadata,
+		BufferHighWaterMark:      o.BufferHighWaterMark,
+		OnBackpressure:           o.OnBackpressure,
+		TempDir:                  o.TempDir,
+		OnControl:                o.OnControl,
+	}
+
+	if limits := o.ResourceLimits; limits != nil {
+		transportOptions.ResourceLimits = &transport.ResourceLimits{
+			MaxMemoryBytes: limits.MaxMemoryBytes,
+			MaxCPUTime:     limits.MaxCPUTime,
+		}
+	}
+
+	// Permission prompts are answered over the control protocol
+	if o.MCPPermissionHandler != nil && o.PermissionPromptToolName == "" {
+		transportOptions.PermissionPromptToolName = "stdio"
+	}
+
+	// A tool policy replaces the flat tool lists
+	if policy := o.ToolPolicy; policy != nil {
+		policy.apply(transportOptions)
+	}
+
+	if o.MCPServers != nil {
+		transportOptions.MCPServers = make(map[string]any, len(o.MCPServers))
+		for name, config := range o.MCPServers {
+			transportOptions.MCPServers[name] = config
+		}
+	}
+
+	return transportOptions
+}
+
+// Validate checks the options for invalid or conflicting settings.
+func (o *Options) Validate() error {
+	if o.CompressInput {
+		return &SDKError{message: "CompressInput is not supported: the CLI has no compressed input format"}
+	}
+	switch o.PermissionMode {
+	case "", PermissionModeDefault, PermissionModeAcceptEdits, PermissionModeBypassPermissions, PermissionModePlan:
+	default:
+		return &SDKError{message: fmt.Sprintf("unknown PermissionMode %q", o.PermissionMode)}
+	}
+	if o.SkipAllPermissions && (o.PermissionPromptToolName != "" || o.MCPPermissionHandler != nil) {
+		return &SDKError{message: "SkipAllPermissions can't be combined with PermissionPromptToolName or MCPPermissionHandler"}
+	}
+	if o.ResourceLimits != nil && o.ResourceLimits.MaxCPUTime < 0 {
+		return &SDKError{message: fmt.Sprintf("ResourceLimits.MaxCPUTime must not be negative, got %v", o.ResourceLimits.MaxCPUTime)}
+	}
+	if o.ToolConfig != nil {
+		if _, err := json.Marshal(o.ToolConfig); err != nil {
+			return &SDKError{message: fmt.Sprintf("ToolConfig is not JSON-serializable: %v", err)}
+		}
+	}
+	if o.MaxPromptTokens < 0 {
+		return &SDKError{message: fmt.Sprintf("MaxPromptTokens must not be negative, got %d", o.MaxPromptTokens)}
+	}
+	if o.Heartbeat < 0 {
+		return &SDKError{message: fmt.Sprintf("Heartbeat must not be negative, got %v", o.Heartbeat)}
+	}
+	if o.BufferHighWaterMark < 0 || o.BufferHighWaterMark >= transport.OutputBufferSize {
+		return &SDKError{message: fmt.Sprintf("BufferHighWaterMark must be between 0 and %d, got %d", transport.OutputBufferSize-1, o.BufferHighWaterMark)}
+	}
+	if o.FirstMessageTimeout < 0 {
+		return &SDKError{message: fmt.Sprintf("FirstMessageTimeout must not be negative, got %v", o.FirstMessageTimeout)}
+	}
+	if o.ControlTimeout < 0 {
+		return &SDKError{message: fmt.Sprintf("ControlTimeout must not be negative, got %v", o.ControlTimeout)}
+	}
+	if o.MaxPendingControl < 0 {
+		return &SDKError{message: fmt.Sprintf("MaxPendingControl must not be negative, got %d", o.MaxPendingControl)}
+	}
+	if o.MaxTokens != nil && *o.MaxTokens <= 0 {
+		return &SDKError{message: fmt.Sprintf("MaxTokens must be positive, got %d", *o.MaxTokens)}
+	}
+	if err := o.validateModel(); err != nil {
+		return err
+	}
+	if o.ToolPolicy != nil {
+		if err := o.ToolPolicy.Validate(); err != nil {
+			return err
+		}
+	}
+	for i, seed := range o.SeedMessages {
+		if _, err := seedEnvelope(seed); err != nil {
+			return &SDKError{message: fmt.Sprintf("SeedMessages[%d]: %v", i, err)}
+		}
+	}
+
+	for name, config := range o.MCPServers {
+		var tlsInsecure bool
+		var timeout int
+		switch c := config.(type) {
+		case MCPSSEServerConfig:
+			tlsInsecure, timeout = c.TLSInsecure, c.Timeout
+		case MCPHTTPServerConfig:
+			tlsInsecure, timeout = c.TLSInsecure, c.Timeout
+		default:
+			continue
+		}
+
+		serverType := config.GetType()
+		if serverType != MCPServerTypeSSE && serverType != MCPServerTypeHTTP && (tlsInsecure || timeout != 0) {
+			return &SDKError{message: fmt.Sprintf("MCP server %q: TLSInsecure and Timeout only apply to sse and http servers, not %q", name, serverType)}
+		}
+		if timeout < 0 {
+			return &SDKError{message: fmt.Sprintf("MCP server %q: Timeout must not be negative", name)}
+		}
+	}
+	return nil
+}
+
 // MarshalJSON customizes JSON marshaling for Options.
+//
+// The tool lists AllowedTools, DisallowedTools and MCPTools are omitted
+// only when nil. A non-nil empty list is encoded as [], so an explicitly
+// empty list, e.g. one clearing an inherited deny list, survives being
+// decoded over inherited options:
+//
+//	var merged Options
+//	json.Unmarshal(inherited, &merged)
+//	json.Unmarshal(overrides, &merged) // "disallowed_tools":[] clears it
 func (o Options) MarshalJSON() ([]byte, error) {
 	type optionsAlias Options
 
@@ -47,18 +379,50 @@ func (o Options) MarshalJSON() ([]byte, error) {
 				"env":     c.Env,
 			}
 		case MCPSSEServerConfig:
-			mcpServers[name] = map[string]any{
-				"type": c.GetType(),
-				"url":  c.URL,
-			}
+			mcpServers[name] = remoteServerConfig(c.GetType(), c.URL, c.Headers, c.TLSInsecure, c.Timeout)
+		case MCPHTTPServerConfig:
+			mcpServers[name] = remoteServerConfig(c.GetType(), c.URL, c.Headers, c.TLSInsecure, c.Timeout)
 		}
 	}
 
 	return json.Marshal(&struct {
 		optionsAlias
-		MCPServers map[string]map[string]any `json:"mcp_servers,omitempty"`
+		MCPServers      map[string]map[string]any `json:"mcp_servers,omitempty"`
+		AllowedTools    *[]string                 `json:"allowed_tools,omitempty"`
+		DisallowedTools *[]string                 `json:"disallowed_tools,omitempty"`
+		MCPTools        *[]string                 `json:"mcp_tools,omitempty"`
 	}{
-		optionsAlias: optionsAlias(o),
-		MCPServers:   mcpServers,
+		optionsAlias:    optionsAlias(o),
+		MCPServers:      mcpServers,
+		AllowedTools:    explicitList(o.AllowedTools),
+		DisallowedTools: explicitList(o.DisallowedTools),
+		MCPTools:        explicitList(o.MCPTools),
 	})
 }
+
+// explicitList returns a pointer to list, or nil if list is nil, so that
+// omitempty drops only unset lists.
+func explicitList(list []string) *[]string {
+	if list == nil {
+		return nil
+	}
+	return &list
+}
+
+// remoteServerConfig builds the CLI representation of an SSE or HTTP MCP server.
+func remoteServerConfig(serverType MCPServerType, url string, headers map[string]string, tlsInsecure bool, timeout int) map[string]any {
+	config := map[string]any{
+		"type": serverType,
+		"url":  url,
+	}
+	if len(headers) > 0 {
+		config["headers"] = headers
+	}
+	if tlsInsecure {
+		config["tlsInsecure"] = true
+	}
+	if timeout > 0 {
+		config["timeout"] = timeout
+	}
+	return config
+}
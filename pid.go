@@ -0,0 +1,17 @@
+package claude
+
+// PID returns the process ID of the CLI and true while it is running, e.g.
+// to correlate it in monitoring or to send it signals. It returns false
+// when not connected, once the process has exited, or if the transport
+// does not run a local process.
+func (c *Client) PID() (int, bool) {
+	c.mu.Lock()
+	trans := c.transport
+	c.mu.Unlock()
+
+	process, ok := trans.(interface{ PID() (int, bool) })
+	if !ok {
+		return 0, false
+	}
+	return process.PID()
+}
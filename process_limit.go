@@ -0,0 +1,67 @@
+package claude
+
+import (
+	"context"
+	"sync"
+)
+
+// processLimiter bounds the number of CLI processes started by Connect
+// that are running at once.
+type processLimiter struct {
+	mu      sync.Mutex
+	limit   int           // 0 for no limit
+	active  int           // connected clients, counted even without a limit
+	changed chan struct{} // closed and replaced when a slot may have freed
+}
+
+// processes is the process-wide limiter shared by every Client.
+var processes = &processLimiter{changed: make(chan struct{})}
+
+// SetMaxConcurrentProcesses limits how many clients, including those
+// started by Query, can be connected at once across the process, so a
+// busy server doesn't start more CLI processes than it can run. While the
+// limit is reached, Connect waits for another client to disconnect, or
+// returns the context's error if ctx is done first.
+//
+// There is no limit by default; n <= 0 removes it again. Lowering the
+// limit doesn't disconnect clients already connected.
+func SetMaxConcurrentProcesses(n int) {
+	processes.mu.Lock()
+	defer processes.mu.Unlock()
+	processes.limit = n
+	processes.broadcast()
+}
+
+// acquire takes a slot, waiting while the limit is reached.
+func (l *processLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.limit <= 0 || l.active < l.limit {
+			l.active++
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// release frees a slot taken by acquire.
+func (l *processLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.broadcast()
+}
+
+// broadcast wakes the waiters in acquire. l.mu must be held.
+func (l *processLimiter) broadcast() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
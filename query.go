@@ -12,8 +12,9 @@ type MessageStream interface {
 
 // StringPrompt wraps a string prompt as a MessageStream
 type stringPrompt struct {
-	prompt string
-	sent   bool
+	prompt    string
+	sent      bool
+	streaming bool // send over stdin instead of --print
 }
 
 func (s *stringPrompt) Next(ctx context.Context) (map[string]any, error) {
@@ -32,6 +33,12 @@ func (s *stringPrompt) Next(ctx context.Context) (map[string]any, error) {
 	}, nil
 }
 
+// IsStreaming reports whether the prompt is sent over a streaming stdin.
+// By default a string prompt is sent with --print instead.
+func (s *stringPrompt) IsStreaming() bool {
+	return s.streaming
+}
+
 // Query sends a query to Claude Code and returns a channel of messages.
 //
 // This function is ideal for simple, stateless queries where you don't need
@@ -67,6 +74,7 @@ func (s *stringPrompt) Next(ctx context.Context) (map[string]any, error) {
 //   - PermissionModeDefault: CLI prompts for dangerous tools
 //   - PermissionModeAcceptEdits: Auto-accept file edits
 //   - PermissionModeBypassPermissions: Allow all tools (use with caution)
+//   - PermissionModePlan: Propose changes without applying them
 //     Set options.Cwd for working directory.
 //
 // Returns:
@@ -124,7 +132,7 @@ func Query(ctx context.Context, prompt any, options *Options) (<-chan MessageRes
 			if msg.Error != nil {
 				return
 			}
-			if _, isResult := msg.Message.(*ResultMessage); isResult {
+			if client.options.endsResponse(msg.Message) {
 				return
 			}
 		}
@@ -132,3 +140,32 @@ func Query(ctx context.Context, prompt any, options *Options) (<-chan MessageRes
 	
 	return out, nil
 }
+
+// QueryInDir runs Query with dir as the working directory. The options are
+// cloned first, so a shared Options value is never mutated; options may be
+// nil.
+func QueryInDir(ctx context.Context, dir string, prompt any, options *Options) (<-chan MessageResult, error) {
+	if options == nil {
+		options = NewOptions()
+	}
+	scoped := options.Clone()
+	scoped.Cwd = dir
+	return Query(ctx, prompt, scoped)
+}
+
+// collectMessages drains a message channel, returning every message received
+// and the first error encountered.
+func collectMessages(messages <-chan MessageResult) ([]Message, error) {
+	var collected []Message
+	var firstErr error
+	for msg := range messages {
+		if msg.Error != nil {
+			if firstErr == nil {
+				firstErr = msg.Error
+			}
+			continue
+		}
+		collected = append(collected, msg.Message)
+	}
+	return collected, firstErr
+}
@@ -0,0 +1,134 @@
+package claude
+
+import "context"
+
+// WaitReady blocks until the CLI has finished starting up, so that a
+// session can hold its first Query until the CLI is ready.
+//
+// In streaming mode the CLI sends its init system message only after
+// reading the first user message, so WaitReady sends an initialize control
+// request instead and returns once the CLI acknowledges it. Otherwise it
+// waits for the init message, which the CLI sends on its own. Either way
+// output is observed by ReceiveMessages, which must be consuming it
+// concurrently.
+//
+// It returns an error if the CLI rejects the handshake or output ends
+// before the CLI is ready, or ctx's error if ctx is done first.
+//
+// Example:
+//
+//	if err := client.Connect(ctx, nil); err != nil {
+//	    log.Fatal(err)
+//	}
+//	messages := client.ReceiveMessages(ctx)
+//	go handle(messages)
+//	if err := client.WaitReady(ctx); err != nil {
+//	    log.Fatal(err)
+//	}
+//	err = client.Query(ctx, "Hello", "default")
+func (c *Client) WaitReady(ctx context.Context) error {
+	c.mu.Lock()
+	trans := c.transport
+	gen := c.readyGeneration()
+	c.mu.Unlock()
+
+	if trans == nil {
+		return NewCLIConnectionError("Not connected. Call Connect() first.")
+	}
+
+	ready, _ := c.readyState()
+	if trans.IsStreaming() && c.claimHandshake(gen) {
+		_, err := c.sendControlRequest(ctx, map[string]any{"subtype": "initialize"})
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			// Abandoned rather than failed; a later call tries again
+			c.releaseHandshake(gen)
+			return ctxErr
+		}
+		c.markReady(gen, err)
+	}
+
+	select {
+	case <-ready:
+		_, err := c.readyState()
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// readyGeneration returns the generation of the current connection's
+// readiness. c.mu must be held, so it matches c.transport.
+func (c *Client) readyGeneration() uint64 {
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
+
+	return c.readyGen
+}
+
+// readyState returns the channel closed once readiness is settled, and the
+// error it settled with.
+func (c *Client) readyState() (<-chan struct{}, error) {
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
+
+	if c.ready == nil {
+		c.ready = make(chan struct{})
+	}
+	return c.ready, c.readyErr
+}
+
+// claimHandshake reports whether the caller should send the initialize
+// handshake for generation gen, which is sent once per connection unless
+// it is abandoned.
+func (c *Client) claimHandshake(gen uint64) bool {
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
+
+	if gen != c.readyGen || c.handshakeGen == gen {
+		return false
+	}
+	c.handshakeGen = gen
+	return true
+}
+
+// releaseHandshake lets a later WaitReady send the handshake for gen again.
+func (c *Client) releaseHandshake(gen uint64) {
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
+
+	if c.handshakeGen == gen {
+		c.handshakeGen = 0
+	}
+}
+
+// markReady settles readiness of generation gen with err, nil meaning the
+// CLI is ready. Only the first call for the current generation has an
+// effect.
+func (c *Client) markReady(gen uint64, err error) {
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
+
+	if gen != c.readyGen {
+		return
+	}
+	if c.ready == nil {
+		c.ready = make(chan struct{})
+	}
+	select {
+	case <-c.ready:
+		return
+	default:
+	}
+	c.readyErr = err
+	close(c.ready)
+}
+
+// resetReady clears readiness for a new connection.
+func (c *Client) resetReady() {
+	c.readyMu.Lock()
+	defer c.readyMu.Unlock()
+
+	c.ready = nil
+	c.readyErr = nil
+	c.readyGen++
+}
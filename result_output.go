@@ -0,0 +1,89 @@
+package claude
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// Text returns the final answer of the turn, or "" if the result carries
+// none, e.g. because the turn ended in an error.
+func (m *ResultMessage) Text() string {
+	if m.Result == nil {
+		return ""
+	}
+	return *m.Result
+}
+
+// ParseResultOutput extracts the ResultMessage from the complete output of
+// a CLI run, whichever --output-format produced it:
+//
+//   - stream-json: one JSON message per line, ending with the result
+//   - json: the result object, or with --verbose an array of every message
+//   - text: the answer as plain text
+//
+// Result, and so Text, is populated the same way for each format. Plain
+// text output yields a successful ResultMessage with no other fields set.
+func ParseResultOutput(output []byte) (*ResultMessage, error) {
+	trimmed := bytes.TrimSpace(output)
+	if len(trimmed) == 0 {
+		return nil, &SDKError{message: "CLI output is empty"}
+	}
+
+	// Output that isn't JSON messages is the plain text answer
+	objects, err := decodeOutputMessages(trimmed)
+	if err != nil {
+		return nil, err
+	}
+	if objects == nil {
+		text := string(trimmed)
+		return &ResultMessage{Subtype: "success", Result: &text}, nil
+	}
+
+	// The result is the last message; older CLIs omit its type in json mode
+	for i := len(objects) - 1; i >= 0; i-- {
+		msgType, typed := objects[i]["type"]
+		_, hasResult := objects[i]["result"]
+		if msgType == "result" || (!typed && hasResult) {
+			return parseResultMessage(objects[i]), nil
+		}
+	}
+	return nil, &SDKError{message: "CLI output contains no result message"}
+}
+
+// decodeOutputMessages decodes a JSON array of messages or a sequence of
+// JSON objects. It returns nil, nil if output does not start with one, and
+// an error if it is cut off or malformed after that. An array counts as
+// started at its first object, so a text answer like "[1] ..." stays text.
+func decodeOutputMessages(output []byte) ([]map[string]any, error) {
+	if output[0] == '[' {
+		if rest := bytes.TrimSpace(output[1:]); len(rest) == 0 || (rest[0] != '{' && rest[0] != ']') {
+			return nil, nil
+		}
+		var objects []map[string]any
+		if err := json.Unmarshal(output, &objects); err != nil {
+			return nil, NewCLIJSONDecodeError(string(output), err)
+		}
+		return objects, nil
+	}
+	if output[0] != '{' {
+		return nil, nil
+	}
+
+	var objects []map[string]any
+	decoder := json.NewDecoder(bytes.NewReader(output))
+	for {
+		var object map[string]any
+		err := decoder.Decode(&object)
+		if err == io.EOF {
+			return objects, nil
+		}
+		if err != nil {
+			if objects == nil {
+				return nil, nil
+			}
+			return nil, NewCLIJSONDecodeError(string(output[decoder.InputOffset():]), err)
+		}
+		objects = append(objects, object)
+	}
+}
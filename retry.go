@@ -0,0 +1,79 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// RetryPolicy decides whether and when QueryWithRetry starts a query again
+// after it failed to start.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first;
+	// 0 defaults to 3
+	MaxAttempts int
+	// Backoff gives the delay before each retry; nil uses the options'
+	// ReconnectBackoff, or retries at once if that is nil too
+	Backoff BackoffStrategy
+	// Retryable reports whether an error is worth retrying; nil uses
+	// IsRetryableConnectionError
+	Retryable func(err error) bool
+}
+
+// IsRetryableConnectionError reports whether err is a CLIConnectionError
+// that may succeed on a retry, such as the CLI exiting during startup. A
+// CLINotFoundError is not retryable: a missing CLI stays missing.
+func IsRetryableConnectionError(err error) bool {
+	var notFound *CLINotFoundError
+	if errors.As(err, &notFound) {
+		return false
+	}
+	var connection *CLIConnectionError
+	return errors.As(err, &connection)
+}
+
+// QueryWithRetry calls Query, starting it again while it fails with an
+// error that policy considers retryable. Only failures to start the query
+// are retried; errors delivered on the returned channel are not. It
+// returns the last error once the attempts run out, or the context's
+// error if ctx is done while waiting to retry.
+//
+// Example:
+//
+//	messages, err := claude.QueryWithRetry(ctx, "Summarize README.md", nil, claude.RetryPolicy{
+//	    MaxAttempts: 5,
+//	    Backoff:     claude.ExponentialBackoff{Initial: 100 * time.Millisecond},
+//	})
+func QueryWithRetry(ctx context.Context, prompt any, options *Options, policy RetryPolicy) (<-chan MessageResult, error) {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = IsRetryableConnectionError
+	}
+	backoff := policy.Backoff
+	if backoff == nil && options != nil {
+		backoff = options.ReconnectBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		messages, err := Query(ctx, prompt, options)
+		if err == nil || attempt >= maxAttempts || !retryable(err) {
+			return messages, err
+		}
+
+		var delay time.Duration
+		if backoff != nil {
+			delay = backoff.NextDelay(attempt)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
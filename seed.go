@@ -0,0 +1,63 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+)
+
+// seededStream sends the seed envelopes built from Options.SeedMessages
+// before the messages of the prompt stream.
+type seededStream struct {
+	seeds  []map[string]any
+	stream MessageStream
+}
+
+// newSeededStream converts seeds to streaming envelopes and returns a
+// stream that sends them ahead of stream.
+func newSeededStream(seeds []Message, stream MessageStream) (*seededStream, error) {
+	envelopes := make([]map[string]any, 0, len(seeds))
+	for i, seed := range seeds {
+		envelope, err := seedEnvelope(seed)
+		if err != nil {
+			return nil, &SDKError{message: fmt.Sprintf("SeedMessages[%d]: %v", i, err)}
+		}
+		envelopes = append(envelopes, envelope)
+	}
+	return &seededStream{seeds: envelopes, stream: stream}, nil
+}
+
+func (s *seededStream) Next(ctx context.Context) (map[string]any, error) {
+	if len(s.seeds) > 0 {
+		seed := s.seeds[0]
+		s.seeds = s.seeds[1:]
+		return seed, nil
+	}
+	return s.stream.Next(ctx)
+}
+
+// CloseInputAtEnd reports whether the wrapped stream asks for stdin to be
+// closed once it ends, such as a StoppableStream.
+func (s *seededStream) CloseInputAtEnd() bool {
+	if closer, ok := s.stream.(interface{ CloseInputAtEnd() bool }); ok {
+		return closer.CloseInputAtEnd()
+	}
+	return false
+}
+
+// seedEnvelope converts a seed user or assistant message to the envelope
+// written to the CLI's stdin.
+func seedEnvelope(msg Message) (map[string]any, error) {
+	switch msg.(type) {
+	case *UserMessage, *AssistantMessage:
+	default:
+		return nil, fmt.Errorf("expected a *UserMessage or *AssistantMessage, got %T", msg)
+	}
+
+	envelope, err := messageToWire(msg)
+	if err != nil {
+		return nil, err
+	}
+	envelope["parent_tool_use_id"] = nil
+	envelope["session_id"] = "default"
+	return envelope, nil
+}
@@ -0,0 +1,109 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/davlia/claude-code-sdk-go/internal/transport"
+)
+
+// selfTestTimeout bounds SelfTest when ctx has no deadline.
+const selfTestTimeout = time.Minute
+
+// findCLI and cliVersion are replaced by tests to avoid depending on an
+// installed CLI.
+var (
+	findCLI    = transport.FindCLI
+	cliVersion = func(ctx context.Context, cliPath string) (string, error) {
+		out, err := exec.CommandContext(ctx, cliPath, "--version").Output()
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+)
+
+// SelfTest is a readiness probe: it locates the CLI, checks that it reports
+// a version, and sends a trivial "ping" prompt, expecting an assistant
+// message followed by a ResultMessage. The returned error names the stage
+// that failed. Without a deadline on ctx, SelfTest gives up after a minute.
+//
+// Example:
+//
+//	if err := claude.SelfTest(ctx); err != nil {
+//	    log.Fatalf("Claude Code is not ready: %v", err)
+//	}
+func SelfTest(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, selfTestTimeout)
+		defer cancel()
+	}
+
+	cliPath, err := findCLI()
+	if err != nil {
+		return fmt.Errorf("self-test: locating CLI: %w", err)
+	}
+
+	version, err := cliVersion(ctx, cliPath)
+	if err != nil {
+		return fmt.Errorf("self-test: checking version of %s: %w", cliPath, err)
+	}
+	if version == "" {
+		return &SDKError{message: fmt.Sprintf("self-test: %s reported no version", cliPath)}
+	}
+
+	options := NewOptions()
+	maxTurns := 1
+	options.MaxTurns = &maxTurns
+
+	client := NewClient(options)
+	if err := client.Connect(ctx, "ping"); err != nil {
+		return fmt.Errorf("self-test: starting query: %w", err)
+	}
+	defer client.Disconnect()
+
+	messages := client.ReceiveMessages(ctx)
+	defer func() {
+		// Let the receiver finish once Disconnect closes the transport
+		go func() {
+			for range messages {
+			}
+		}()
+	}()
+
+	sawAssistant := false
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				if !sawAssistant {
+					return &SDKError{message: "self-test: query ended without an assistant message"}
+				}
+				return &SDKError{message: "self-test: query ended without a result message"}
+			}
+			if msg.Error != nil {
+				return fmt.Errorf("self-test: running query: %w", msg.Error)
+			}
+
+			switch m := msg.Message.(type) {
+			case *AssistantMessage:
+				sawAssistant = true
+			case *ResultMessage:
+				if m.IsError {
+					return &SDKError{message: fmt.Sprintf("self-test: query failed with result %q", m.Subtype)}
+				}
+				if !sawAssistant {
+					return &SDKError{message: "self-test: result arrived without an assistant message"}
+				}
+				return nil
+			}
+
+		case <-ctx.Done():
+			return fmt.Errorf("self-test: waiting for response: %w", ctx.Err())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package claude
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ShutdownGroup interrupts and disconnects a set of clients together, e.g.
+// when a program embedding the SDK receives SIGINT or SIGTERM.
+//
+// Example:
+//
+//	group := NewShutdownGroup()
+//	stop := group.ListenForSignals(5 * time.Second)
+//	defer stop()
+//
+//	client := NewClient(nil)
+//	group.Register(client)
+type ShutdownGroup struct {
+	mu      sync.Mutex
+	clients map[*Client]struct{}
+}
+
+// NewShutdownGroup creates an empty ShutdownGroup.
+func NewShutdownGroup() *ShutdownGroup {
+	return &ShutdownGroup{clients: make(map[*Client]struct{})}
+}
+
+// Register adds a client to the group.
+func (g *ShutdownGroup) Register(client *Client) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.clients[client] = struct{}{}
+}
+
+// Unregister removes a client from the group, e.g. after it has been
+// disconnected normally.
+func (g *ShutdownGroup) Unregister(client *Client) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.clients, client)
+}
+
+// Shutdown interrupts every registered client and then disconnects it,
+// handling clients concurrently. Interrupts are best effort, since a client
+// may be idle or not streaming. Shutdown returns once all clients are
+// disconnected or ctx is done, joining any Disconnect errors and ctx's
+// error. Clients are unregistered.
+func (g *ShutdownGroup) Shutdown(ctx context.Context) error {
+	g.mu.Lock()
+	clients := make([]*Client, 0, len(g.clients))
+	for client := range g.clients {
+		clients = append(clients, client)
+	}
+	g.clients = make(map[*Client]struct{})
+	g.mu.Unlock()
+
+	errs := make(chan error, len(clients))
+	for _, client := range clients {
+		go func(client *Client) {
+			_ = client.Interrupt(ctx)
+			errs <- client.Disconnect()
+		}(client)
+	}
+
+	var result []error
+	for range clients {
+		select {
+		case err := <-errs:
+			result = append(result, err)
+		case <-ctx.Done():
+			return errors.Join(append(result, ctx.Err())...)
+		}
+	}
+	return errors.Join(result...)
+}
+
+// ListenForSignals shuts the group down when one of signals is received,
+// allowing timeout for the shutdown to complete. With no signals it
+// listens for SIGINT and SIGTERM. Listening stops at the first signal, so
+// a second one gets the default behavior, e.g. exiting at once while the
+// shutdown is still waiting. The returned function stops listening.
+func (g *ShutdownGroup) ListenForSignals(timeout time.Duration, signals ...os.Signal) (stop func()) {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigCh, signals...)
+
+	go func() {
+		select {
+		case <-sigCh:
+			signal.Stop(sigCh)
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			_ = g.Shutdown(ctx)
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(sigCh)
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package claude
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// ServeSSE writes messages to w as Server-Sent Events, for forwarding
+// Claude's output to a browser:
+//
+//	messages, err := claude.Query(r.Context(), prompt, nil)
+//	if err != nil { ... }
+//	claude.ServeSSE(w, messages)
+//
+// Each message is one event named after its type ("assistant", "user",
+// "system", "result" or "stream_event") whose data is the message in the
+// CLI's stream-json shape. An error is sent as an "error" event with data
+// {"error": "..."}. Events are flushed as they are written when w supports
+// it. ServeSSE returns after the result or the first error without reading
+// the rest of messages, so the caller should cancel the query's context
+// when it returns.
+func ServeSSE(w http.ResponseWriter, messages <-chan MessageResult) {
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	send := func(event string, data any) bool {
+		payload, err := json.Marshal(data)
+		if err != nil {
+			payload, _ = json.Marshal(map[string]any{"error": err.Error()})
+			event = "error"
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return event != "error"
+	}
+
+	for msg := range messages {
+		if msg.Error != nil {
+			send("error", map[string]any{"error": msg.Error.Error()})
+			return
+		}
+
+		wire, err := messageToWire(msg.Message)
+		if err != nil {
+			send("error", map[string]any{"error": err.Error()})
+			return
+		}
+		event, _ := wire["type"].(string)
+		if !send(event, wire) {
+			return
+		}
+
+		if _, ok := msg.Message.(*ResultMessage); ok {
+			return
+		}
+	}
+}
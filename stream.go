@@ -0,0 +1,71 @@
+package claude
+
+import (
+	"context"
+	"io"
+	"strings"
+)
+
+// Stream runs a query and writes the assistant's text to w as each
+// assistant message arrives, returning the final ResultMessage. It is the
+// simplest way to print Claude's answer:
+//
+//	result, err := claude.Stream(ctx, "Explain goroutines", nil, os.Stdout)
+//
+// Text blocks are written as they are, without separators; tool use and
+// other content is not written. The prompt is passed to Query, so it may be
+// a string or a MessageStream. If writing to w fails, the query is still
+// read to the end and the write error is returned.
+func Stream(ctx context.Context, prompt any, options *Options, w io.Writer) (*ResultMessage, error) {
+	messages, err := Query(ctx, prompt, options)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *ResultMessage
+	var firstErr error
+	for msg := range messages {
+		if msg.Error != nil {
+			if firstErr == nil {
+				firstErr = msg.Error
+			}
+			continue
+		}
+
+		switch m := msg.Message.(type) {
+		case *AssistantMessage:
+			if firstErr != nil {
+				continue
+			}
+			for _, block := range m.Content {
+				if text, ok := block.(*TextBlock); ok {
+					if _, err := io.WriteString(w, text.Text); err != nil {
+						firstErr = err
+						break
+					}
+				}
+			}
+		case *ResultMessage:
+			result = m
+		}
+	}
+
+	if firstErr != nil {
+		return result, firstErr
+	}
+	if result == nil {
+		return nil, &SDKError{message: "query completed without a result message"}
+	}
+	return result, nil
+}
+
+// Ask runs a query and returns the assistant's text, concatenated from all
+// of its text blocks, along with the final ResultMessage. It is the
+// simplest way to get an answer:
+//
+//	answer, _, err := claude.Ask(ctx, "What is the capital of France?", nil)
+func Ask(ctx context.Context, prompt string, options *Options) (string, *ResultMessage, error) {
+	var answer strings.Builder
+	result, err := Stream(ctx, prompt, options, &answer)
+	return answer.String(), result, err
+}
@@ -1,5 +1,10 @@
 package claude
 
+import (
+	"context"
+	"sync"
+)
+
 // IsStringPrompt checks if a MessageStream is a simple string prompt.
 // This is useful for determining whether to use streaming mode or not.
 func IsStringPrompt(stream MessageStream) bool {
@@ -28,4 +33,96 @@ func NewStringPromptStream(prompt string) MessageStream {
 // NewEmptyStream creates an empty MessageStream for interactive use.
 func NewEmptyStream() MessageStream {
 	return &emptyStream{}
-}
\ No newline at end of file
+}
+
+// NewStringChannelStream creates a MessageStream that sends each string
+// received from in as a user message, and ends when in is closed. It suits
+// chat UIs where user input arrives on a channel.
+func NewStringChannelStream(in <-chan string) MessageStream {
+	return &stringChannelStream{in: in, builder: NewMessageBuilder("")}
+}
+
+// stringChannelStream wraps a channel of strings as a MessageStream
+type stringChannelStream struct {
+	in      <-chan string
+	builder *MessageBuilder
+}
+
+func (s *stringChannelStream) Next(ctx context.Context) (map[string]any, error) {
+	select {
+	case text, ok := <-s.in:
+		if !ok {
+			return nil, nil // EOF
+		}
+		return s.builder.UserText(text), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// NewStoppableStream wraps stream so that sending can be ended without
+// disconnecting. Once Done is called, or stream itself ends, the stream
+// reports a clean end and the CLI's stdin is closed, signalling that no
+// more input will follow; responses to what was already sent can still be
+// received. It suits streams such as NewStringChannelStream whose source
+// can't simply be closed.
+//
+// Example:
+//
+//	prompts := claude.NewStoppableStream(claude.NewStringChannelStream(input))
+//	client.Connect(ctx, prompts)
+//	// ...
+//	prompts.Done() // finish sending, keep receiving
+func NewStoppableStream(stream MessageStream) *StoppableStream {
+	return &StoppableStream{stream: stream, done: make(chan struct{})}
+}
+
+// StoppableStream is a MessageStream that can be ended with Done, see
+// NewStoppableStream.
+type StoppableStream struct {
+	stream MessageStream
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Next returns the wrapped stream's next message, or EOF once Done has been
+// called, including while waiting for a message.
+func (s *StoppableStream) Next(ctx context.Context) (map[string]any, error) {
+	select {
+	case <-s.done:
+		return nil, nil // EOF
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	msg, err := s.stream.Next(ctx)
+	if err != nil {
+		select {
+		case <-s.done:
+			return nil, nil // EOF
+		default:
+		}
+	}
+	return msg, err
+}
+
+// Done ends the stream. It is safe to call more than once and from any
+// goroutine.
+func (s *StoppableStream) Done() {
+	s.once.Do(func() { close(s.done) })
+}
+
+// CloseInputAtEnd tells the transport to close the CLI's stdin once the
+// stream ends.
+func (s *StoppableStream) CloseInputAtEnd() bool {
+	return true
+}
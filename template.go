@@ -0,0 +1,48 @@
+package claude
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// QueryTemplate renders tmpl with vars using text/template and sends the
+// result as a Query. Referencing a variable missing from vars is an error,
+// so typos in prompt libraries fail before anything is sent.
+//
+// Example:
+//
+//	messages, err := QueryTemplate(ctx, "Explain {{.topic}} to a {{.audience}}",
+//	    map[string]any{"topic": "goroutines", "audience": "beginner"}, nil)
+func QueryTemplate(ctx context.Context, tmpl string, vars map[string]any, options *Options) (<-chan MessageResult, error) {
+	prompt, err := renderPrompt(tmpl, vars)
+	if err != nil {
+		return nil, err
+	}
+	return Query(ctx, prompt, options)
+}
+
+// QueryTemplate renders tmpl with vars using text/template and sends the
+// result with Query. Referencing a variable missing from vars is an error.
+func (c *Client) QueryTemplate(ctx context.Context, tmpl string, vars map[string]any, sessionID string) error {
+	prompt, err := renderPrompt(tmpl, vars)
+	if err != nil {
+		return err
+	}
+	return c.Query(ctx, prompt, sessionID)
+}
+
+// renderPrompt executes a prompt template with strict missing-key handling.
+func renderPrompt(tmpl string, vars map[string]any) (string, error) {
+	t, err := template.New("prompt").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", &SDKError{message: fmt.Sprintf("invalid prompt template: %v", err)}
+	}
+
+	var sb strings.Builder
+	if err := t.Execute(&sb, vars); err != nil {
+		return "", &SDKError{message: fmt.Sprintf("failed to render prompt template: %v", err)}
+	}
+	return sb.String(), nil
+}
@@ -0,0 +1,33 @@
+package claude
+
+import "time"
+
+// Timings records when the stages of a connection happened, for latency
+// diagnostics. Stages that have not happened yet are zero.
+type Timings struct {
+	ConnectStart   time.Time // Connect was called
+	ProcessSpawned time.Time // the CLI process started, if the transport reports it
+	FirstMessage   time.Time // the first message was received
+	FirstResult    time.Time // the first ResultMessage was received
+}
+
+// Timings returns the lifecycle timings of the current connection.
+func (c *Client) Timings() Timings {
+	c.timingsMu.Lock()
+	defer c.timingsMu.Unlock()
+	return c.timings
+}
+
+// recordTimings notes the first message and first result as they arrive.
+func (c *Client) recordTimings(msg Message) {
+	c.timingsMu.Lock()
+	defer c.timingsMu.Unlock()
+
+	now := time.Now()
+	if c.timings.FirstMessage.IsZero() {
+		c.timings.FirstMessage = now
+	}
+	if _, ok := msg.(*ResultMessage); ok && c.timings.FirstResult.IsZero() {
+		c.timings.FirstResult = now
+	}
+}
@@ -0,0 +1,29 @@
+package claude
+
+import "strings"
+
+// EstimateTokens returns a rough estimate of the number of tokens text
+// takes up, for checking whether a prompt fits a budget before sending it.
+// It is a heuristic, not the model's tokenizer: it assumes about four bytes
+// per token, or four tokens for every three words when that is larger.
+// Actual counts vary with the language and content, so leave a margin.
+func EstimateTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+	byBytes := (len(text) + 3) / 4
+	byWords := (len(strings.Fields(text))*4 + 2) / 3
+	return max(byBytes, byWords)
+}
+
+// checkPromptTokens rejects a prompt whose estimated size exceeds
+// Options.MaxPromptTokens.
+func (o *Options) checkPromptTokens(prompt string) error {
+	if o.MaxPromptTokens <= 0 {
+		return nil
+	}
+	if estimate := EstimateTokens(prompt); estimate > o.MaxPromptTokens {
+		return NewPromptTooLongError(estimate, o.MaxPromptTokens)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package claude
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// ToolInputDelta is a fragment of a tool use's input, streamed when
+// Options.IncludePartialMessages is set.
+type ToolInputDelta struct {
+	Index       int // content block index within the assistant message
+	ToolUseID   string
+	Name        string
+	PartialJSON string // this fragment of the input JSON, empty on the final delta
+
+	// Block is set on the final delta, once the tool use's content block has
+	// ended, with Input assembled from all fragments. Err is set instead if
+	// the assembled input is not a valid JSON object.
+	Block *ToolUseBlock
+	Err   error
+}
+
+// ReceiveToolInputDeltas returns a channel that yields tool use input as it
+// streams. Each input_json_delta fragment is yielded as it arrives, followed
+// by a final delta carrying the complete ToolUseBlock when the block ends.
+// It requires Options.IncludePartialMessages; the assistant message with
+// the complete tool use still follows as usual.
+//
+// Like ReceiveToolResults, this consumes messages from the connection;
+// other message types are discarded. The channel closes when the
+// underlying message stream ends or yields an error.
+func (c *Client) ReceiveToolInputDeltas(ctx context.Context) <-chan ToolInputDelta {
+	out := make(chan ToolInputDelta)
+	// The receiver stops when this does, so it can't take messages meant
+	// for a later call
+	receiveCtx, cancel := context.WithCancel(ctx)
+	messages := c.ReceiveMessages(receiveCtx)
+
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		assembler := newToolInputAssembler()
+		for msg := range messages {
+			if msg.Error != nil {
+				return
+			}
+
+			event, ok := msg.Message.(*StreamEvent)
+			if !ok {
+				continue
+			}
+
+			if delta := assembler.handle(event.Event); delta != nil {
+				select {
+				case out <- *delta:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// toolInputAssembler accumulates input_json_delta fragments per content
+// block of the assistant message being streamed.
+type toolInputAssembler struct {
+	blocks map[int]*pendingToolInput
+}
+
+type pendingToolInput struct {
+	id    string
+	name  string
+	input strings.Builder
+}
+
+func newToolInputAssembler() *toolInputAssembler {
+	return &toolInputAssembler{blocks: make(map[int]*pendingToolInput)}
+}
+
+// handle processes a streaming event and returns the delta it produces, if
+// any. Events for content blocks other than tool uses are ignored.
+func (a *toolInputAssembler) handle(event map[string]any) *ToolInputDelta {
+	index := 0
+	if val, ok := event["index"].(float64); ok {
+		index = int(val)
+	}
+
+	switch event["type"] {
+	case "message_start":
+		a.blocks = make(map[int]*pendingToolInput)
+
+	case "content_block_start":
+		block, _ := event["content_block"].(map[string]any)
+		if block["type"] != "tool_use" {
+			return nil
+		}
+		pending := &pendingToolInput{}
+		pending.id, _ = block["id"].(string)
+		pending.name, _ = block["name"].(string)
+		a.blocks[index] = pending
+
+	case "content_block_delta":
+		pending, ok := a.blocks[index]
+		delta, _ := event["delta"].(map[string]any)
+		if !ok || delta["type"] != "input_json_delta" {
+			return nil
+		}
+		fragment, _ := delta["partial_json"].(string)
+		pending.input.WriteString(fragment)
+		return &ToolInputDelta{Index: index, ToolUseID: pending.id, Name: pending.name, PartialJSON: fragment}
+
+	case "content_block_stop":
+		pending, ok := a.blocks[index]
+		if !ok {
+			return nil
+		}
+		delete(a.blocks, index)
+
+		delta := &ToolInputDelta{Index: index, ToolUseID: pending.id, Name: pending.name}
+		input := map[string]any{}
+		if raw := pending.input.String(); raw != "" {
+			if err := json.Unmarshal([]byte(raw), &input); err != nil {
+				delta.Err = NewCLIJSONDecodeError(raw, err)
+				return delta
+			}
+		}
+		delta.Block = &ToolUseBlock{ID: pending.id, Name: pending.name, Input: input}
+		return delta
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package claude
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/davlia/claude-code-sdk-go/internal/transport"
+)
+
+// ToolPolicy describes which tools Claude may use in one place, for
+// servers that need to both configure the CLI and enforce the same rules
+// locally (e.g. in a permission prompt handler).
+//
+// Entries use the CLI's permission rule syntax: a tool name such as "Read",
+// an MCP server such as "mcp__github" covering all of that server's tools,
+// or a tool with a specifier such as "Bash(git:*)" covering only some uses
+// of it. Tool names can't contain wildcards; Validate rejects entries the
+// CLI wouldn't understand.
+type ToolPolicy struct {
+	// Allow lists tools that are always permitted.
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists tools that are never permitted. Deny takes precedence
+	// over Allow.
+	Deny []string `json:"deny,omitempty"`
+	// DefaultAllow decides tools matching neither list.
+	DefaultAllow bool `json:"default_allow,omitempty"`
+}
+
+// Args compiles the policy into CLI flags. DefaultAllow has no flag
+// equivalent: tools in neither list fall back to the CLI's permission mode.
+func (p *ToolPolicy) Args() []string {
+	options := &transport.Options{}
+	p.apply(options)
+	return options.ToolArgs()
+}
+
+// apply sets the CLI tool lists in options from the policy.
+func (p *ToolPolicy) apply(options *transport.Options) {
+	options.AllowedTools = p.Allow
+	options.DisallowedTools = p.Deny
+}
+
+// Validate checks that every entry is a rule the CLI understands.
+func (p *ToolPolicy) Validate() error {
+	for _, rules := range [][]string{p.Allow, p.Deny} {
+		for _, rule := range rules {
+			if _, _, err := parseToolRule(rule); err != nil {
+				return &SDKError{message: fmt.Sprintf("ToolPolicy: invalid rule %q: %v", rule, err)}
+			}
+		}
+	}
+	return nil
+}
+
+// Permit reports whether the policy allows tool.
+//
+// Permit sees only the tool name, so it errs towards refusing when a rule
+// has a specifier: a Deny rule such as "Bash(rm:*)" refuses the whole tool,
+// while an Allow rule such as "Bash(git:*)" doesn't permit it.
+func (p *ToolPolicy) Permit(tool string) bool {
+	if matchesTool(p.Deny, tool, true) {
+		return false
+	}
+	if matchesTool(p.Allow, tool, false) {
+		return true
+	}
+	return p.DefaultAllow
+}
+
+// matchesTool reports whether tool matches any of the rules. Rules with a
+// specifier match only if withSpecifier is set.
+func matchesTool(rules []string, tool string, withSpecifier bool) bool {
+	for _, rule := range rules {
+		name, specifier, err := parseToolRule(rule)
+		if err != nil || (specifier != "" && !withSpecifier) {
+			continue
+		}
+		if name == tool {
+			return true
+		}
+		// A server-level MCP rule covers every tool of that server
+		if server, ok := strings.CutPrefix(name, "mcp__"); ok && !strings.Contains(server, "__") &&
+			strings.HasPrefix(tool, name+"__") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseToolRule splits a rule such as "Bash(git:*)" into its tool name and
+// specifier.
+func parseToolRule(rule string) (name, specifier string, err error) {
+	name = rule
+	if open := strings.IndexByte(rule, '('); open >= 0 {
+		if !strings.HasSuffix(rule, ")") {
+			return "", "", fmt.Errorf("specifier must end with ')'")
+		}
+		name, specifier = rule[:open], rule[open+1:len(rule)-1]
+		if specifier == "" {
+			return "", "", fmt.Errorf("specifier must not be empty")
+		}
+	}
+	if name == "" {
+		return "", "", fmt.Errorf("tool name must not be empty")
+	}
+	if strings.Contains(name, "*") {
+		return "", "", fmt.Errorf("tool names can't contain wildcards; use \"mcp__<server>\" to cover all of a server's tools")
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-') {
+			return "", "", fmt.Errorf("tool name must not contain %q", r)
+		}
+	}
+	return name, specifier, nil
+}
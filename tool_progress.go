@@ -0,0 +1,66 @@
+package claude
+
+import "context"
+
+// ReceiveToolProgress returns a channel that yields the CLI's progress
+// updates for running tools, so a UI can show the status of each tool
+// while it runs. Updates are correlated with the tool use they report on
+// by tool_use_id: ToolUse is set to the ToolUseBlock from the assistant
+// message that requested the tool, and ToolName is filled from it when the
+// update doesn't carry one.
+//
+// Like ReceiveToolResults, this consumes messages from the connection;
+// other message types are discarded. The channel closes when the
+// underlying message stream ends or yields an error.
+func (c *Client) ReceiveToolProgress(ctx context.Context) <-chan ToolProgress {
+	out := make(chan ToolProgress)
+	// The receiver stops when this does, so it can't take messages meant
+	// for a later call
+	receiveCtx, cancel := context.WithCancel(ctx)
+	messages := c.ReceiveMessages(receiveCtx)
+
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		// Tool uses awaiting their result, by ID
+		toolUses := make(map[string]*ToolUseBlock)
+		for msg := range messages {
+			if msg.Error != nil {
+				return
+			}
+
+			switch m := msg.Message.(type) {
+			case *AssistantMessage:
+				for _, block := range m.Content {
+					if toolUse, ok := block.(*ToolUseBlock); ok {
+						toolUses[toolUse.ID] = toolUse
+					}
+				}
+
+			case *UserMessage:
+				for _, block := range m.Blocks {
+					if result, ok := block.(*ToolResultBlock); ok && !result.Partial {
+						delete(toolUses, result.ToolUseID)
+					}
+				}
+
+			case *ToolProgress:
+				progress := *m
+				if toolUse, ok := toolUses[progress.ToolUseID]; ok {
+					progress.ToolUse = toolUse
+					if progress.ToolName == "" {
+						progress.ToolName = toolUse.Name
+					}
+				}
+				select {
+				case out <- progress:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
@@ -0,0 +1,104 @@
+package claude
+
+import "context"
+
+// ReceiveToolResults returns a channel that yields complete tool results.
+//
+// Large tool outputs may arrive as several tool_result fragments for the
+// same tool_use_id, each but the last marked Partial. Fragments are
+// buffered and reassembled in arrival order, and only the complete result
+// is yielded. String fragments are concatenated; otherwise the content
+// block arrays are appended.
+//
+// Like ReceiveResponse, this consumes messages from the connection; other
+// message types are discarded. The channel closes when the underlying
+// message stream ends or yields an error (use ReceiveMessages to observe
+// errors).
+func (c *Client) ReceiveToolResults(ctx context.Context) <-chan *ToolResultBlock {
+	out := make(chan *ToolResultBlock)
+	// The receiver stops when this does, so it can't take messages meant
+	// for a later call
+	receiveCtx, cancel := context.WithCancel(ctx)
+	messages := c.ReceiveMessages(receiveCtx)
+
+	go func() {
+		defer close(out)
+		defer cancel()
+
+		pending := make(map[string]*ToolResultBlock)
+		for msg := range messages {
+			if msg.Error != nil {
+				return
+			}
+
+			userMsg, ok := msg.Message.(*UserMessage)
+			if !ok {
+				continue
+			}
+
+			for _, block := range userMsg.Blocks {
+				toolResult, ok := block.(*ToolResultBlock)
+				if !ok {
+					continue
+				}
+
+				if complete := reassembleToolResult(pending, toolResult); complete != nil {
+					select {
+					case out <- complete:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// reassembleToolResult merges a tool result fragment into pending and
+// returns the complete result once its final fragment arrives.
+func reassembleToolResult(pending map[string]*ToolResultBlock, fragment *ToolResultBlock) *ToolResultBlock {
+	result, ok := pending[fragment.ToolUseID]
+	if !ok {
+		result = &ToolResultBlock{ToolUseID: fragment.ToolUseID, Content: fragment.Content, Blocks: fragment.Blocks}
+	} else {
+		result.Content = mergeToolResultContent(result.Content, fragment.Content)
+		result.Blocks = parseNestedContentBlocks(result.Content)
+	}
+	if fragment.IsError != nil {
+		result.IsError = fragment.IsError
+	}
+
+	if fragment.Partial {
+		pending[fragment.ToolUseID] = result
+		return nil
+	}
+
+	delete(pending, fragment.ToolUseID)
+	return result
+}
+
+// mergeToolResultContent appends the content of one fragment to another.
+func mergeToolResultContent(a, b any) any {
+	if aStr, ok := a.(string); ok {
+		if bStr, ok := b.(string); ok {
+			return aStr + bStr
+		}
+	}
+	return append(toolResultContentBlocks(a), toolResultContentBlocks(b)...)
+}
+
+// toolResultContentBlocks normalizes tool result content to a block array.
+func toolResultContentBlocks(content any) []any {
+	switch c := content.(type) {
+	case nil:
+		return nil
+	case string:
+		return []any{map[string]any{"type": "text", "text": c}}
+	case []any:
+		return c
+	default:
+		return []any{c}
+	}
+}
@@ -1,6 +1,9 @@
 package claude
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // PermissionMode defines how tool permissions are handled
 type PermissionMode string
@@ -12,6 +15,8 @@ const (
 	PermissionModeAcceptEdits PermissionMode = "acceptEdits"
 	// PermissionModeBypassPermissions allows all tools (use with caution)
 	PermissionModeBypassPermissions PermissionMode = "bypassPermissions"
+	// PermissionModePlan proposes changes without applying them (read-only)
+	PermissionModePlan PermissionMode = "plan"
 )
 
 // MCPServerType defines the type of MCP server
@@ -45,9 +50,11 @@ func (c MCPStdioServerConfig) GetType() MCPServerType {
 
 // MCPSSEServerConfig represents MCP SSE server configuration
 type MCPSSEServerConfig struct {
-	Type    MCPServerType     `json:"type"`
-	URL     string            `json:"url"`
-	Headers map[string]string `json:"headers,omitempty"`
+	Type        MCPServerType     `json:"type"`
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	TLSInsecure bool              `json:"tlsInsecure,omitempty"` // skip TLS certificate verification
+	Timeout     int               `json:"timeout,omitempty"`     // request timeout in milliseconds
 }
 
 func (c MCPSSEServerConfig) GetType() MCPServerType {
@@ -56,9 +63,11 @@ func (c MCPSSEServerConfig) GetType() MCPServerType {
 
 // MCPHTTPServerConfig represents MCP HTTP server configuration
 type MCPHTTPServerConfig struct {
-	Type    MCPServerType     `json:"type"`
-	URL     string            `json:"url"`
-	Headers map[string]string `json:"headers,omitempty"`
+	Type        MCPServerType     `json:"type"`
+	URL         string            `json:"url"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	TLSInsecure bool              `json:"tlsInsecure,omitempty"` // skip TLS certificate verification
+	Timeout     int               `json:"timeout,omitempty"`     // request timeout in milliseconds
 }
 
 func (c MCPHTTPServerConfig) GetType() MCPServerType {
@@ -86,15 +95,79 @@ type ToolUseBlock struct {
 
 func (ToolUseBlock) contentBlock() {}
 
+// ImageBlock represents image content, such as an image returned by a tool
+type ImageBlock struct {
+	Source map[string]any `json:"source"` // e.g. {"type": "base64", "media_type": "image/png", "data": "..."}
+}
+
+func (ImageBlock) contentBlock() {}
+
+// DocumentBlock represents a document, such as a PDF, sent for analysis.
+// Its source is either inline data or a file path on the CLI's machine.
+type DocumentBlock struct {
+	SourceType string `json:"source_type"`          // "base64", "text" or "file"
+	MediaType  string `json:"media_type,omitempty"` // e.g. "application/pdf"
+	Data       string `json:"data,omitempty"`       // base64 or plain text, per SourceType
+	Path       string `json:"path,omitempty"`       // set when SourceType is "file"
+	Title      string `json:"title,omitempty"`
+}
+
+func (DocumentBlock) contentBlock() {}
+
+// toWire converts the block to the shape the CLI expects, omitting unset
+// source fields.
+func (b DocumentBlock) toWire() map[string]any {
+	source := map[string]any{"type": b.SourceType}
+	if b.MediaType != "" {
+		source["media_type"] = b.MediaType
+	}
+	if b.Data != "" {
+		source["data"] = b.Data
+	}
+	if b.Path != "" {
+		source["path"] = b.Path
+	}
+	block := map[string]any{"type": "document", "source": source}
+	if b.Title != "" {
+		block["title"] = b.Title
+	}
+	return block
+}
+
 // ToolResultBlock represents tool result
 type ToolResultBlock struct {
 	ToolUseID string `json:"tool_use_id"`
 	Content   any    `json:"content,omitempty"` // string or []map[string]any
 	IsError   *bool  `json:"is_error,omitempty"`
+	Partial   bool   `json:"partial,omitempty"` // more fragments follow for this tool use
+	// Blocks holds the parsed content when Content is an array of
+	// recognizable blocks, such as text and images; nil otherwise
+	Blocks []ContentBlock `json:"-"`
 }
 
 func (ToolResultBlock) contentBlock() {}
 
+// toWire converts the block to the shape the CLI expects. Content and
+// is_error are omitted when unset.
+func (b ToolResultBlock) toWire() map[string]any {
+	block := map[string]any{
+		"type":        "tool_result",
+		"tool_use_id": b.ToolUseID,
+	}
+	if b.Content != nil {
+		block["content"] = b.Content
+	}
+	if b.IsError != nil {
+		block["is_error"] = *b.IsError
+	}
+	return block
+}
+
+// toEnvelope wraps the block in a user message linked to its tool use.
+func (b ToolResultBlock) toEnvelope(sessionID string) map[string]any {
+	return NewMessageBuilder(sessionID).envelope([]any{b.toWire()}, b.ToolUseID)
+}
+
 // Message is the interface for all message types
 type Message interface {
 	message()
@@ -103,13 +176,20 @@ type Message interface {
 // UserMessage represents a user message
 type UserMessage struct {
 	Content string `json:"content"`
+	// Blocks holds structured content, such as tool results, when the
+	// message content is a block array rather than a string
+	Blocks []ContentBlock `json:"blocks,omitempty"`
 }
 
 func (UserMessage) message() {}
 
 // AssistantMessage represents an assistant message with content blocks
 type AssistantMessage struct {
-	Content []ContentBlock `json:"content"`
+	ID           string         `json:"id,omitempty"`    // API message ID, shared by the messages of one response
+	Model        string         `json:"model,omitempty"` // model that generated the message
+	Content      []ContentBlock `json:"content"`
+	StopReason   string         `json:"stop_reason,omitempty"`   // e.g. "end_turn", "max_tokens"
+	StopSequence string         `json:"stop_sequence,omitempty"` // set when StopReason is "stop_sequence"
 }
 
 func (AssistantMessage) message() {}
@@ -117,11 +197,66 @@ func (AssistantMessage) message() {}
 // SystemMessage represents a system message with metadata
 type SystemMessage struct {
 	Subtype string         `json:"subtype"`
-	Data    map[string]any `json:"data"`
+	Data    map[string]any `json:"data"` // the message's "data" object, nil if it has none
+
+	// Set from the top level of messages such as init, which don't nest
+	// their fields under "data"
+	SessionID  string `json:"session_id,omitempty"`
+	WorkingDir string `json:"cwd,omitempty"`
+	Version    string `json:"claude_code_version,omitempty"`
 }
 
 func (SystemMessage) message() {}
 
+// Cwd returns the working directory the CLI resolved, as reported by the
+// init message, or "" if not present.
+func (m *SystemMessage) Cwd() string {
+	if m.WorkingDir != "" {
+		return m.WorkingDir
+	}
+	cwd, _ := m.Data["cwd"].(string)
+	return cwd
+}
+
+// CLIVersion returns the version of the CLI that served the session, as
+// reported by the init message, or "" if absent.
+func (m *SystemMessage) CLIVersion() string {
+	if m.Version != "" {
+		return m.Version
+	}
+	for _, key := range []string{"claude_code_version", "version"} {
+		if version, ok := m.Data[key].(string); ok {
+			return version
+		}
+	}
+	return ""
+}
+
+// ThinkingBudgetExceeded reports whether the CLI signalled that extended
+// thinking ran past Options.MaxThinkingTokens.
+//
+// This is best effort: the "thinking_budget_exceeded" subtype has not been
+// confirmed against real CLI output, so a false result doesn't mean the
+// budget was respected.
+func (m *SystemMessage) ThinkingBudgetExceeded() bool {
+	return m.Subtype == "thinking_budget_exceeded"
+}
+
+// ThinkingTokens returns the configured thinking budget and the thinking
+// tokens actually used, when the message reports them. A value of 0 means
+// the field was absent. Like ThinkingBudgetExceeded it is best effort: the
+// "budget_tokens" and "thinking_tokens" names are unverified against real
+// CLI output.
+func (m *SystemMessage) ThinkingTokens() (budget, used int) {
+	if val, ok := m.Data["budget_tokens"].(float64); ok {
+		budget = int(val)
+	}
+	if val, ok := m.Data["thinking_tokens"].(float64); ok {
+		used = int(val)
+	}
+	return budget, used
+}
+
 // ResultMessage represents a result message with cost and usage information
 type ResultMessage struct {
 	Subtype       string         `json:"subtype"`
@@ -133,10 +268,84 @@ type ResultMessage struct {
 	TotalCostUSD  *float64       `json:"total_cost_usd,omitempty"`
 	Usage         map[string]any `json:"usage,omitempty"`
 	Result        *string        `json:"result,omitempty"`
+	StopReason    string         `json:"stop_reason,omitempty"`
+	ServiceTier   string         `json:"service_tier,omitempty"` // e.g. "standard", "priority" or "batch"
+	ErrorType     string         `json:"error_type,omitempty"`   // kind of failure of an error result, e.g. "overloaded_error"
+	ErrorMessage  string         `json:"error_message,omitempty"`
+
+	// PermissionDenials lists the tool uses blocked during the turn
+	PermissionDenials []PermissionDenial `json:"permission_denials,omitempty"`
+
+	// Metadata is the request metadata echoed by the CLI, or else the
+	// client's Options.Metadata, for correlating results with requests
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 func (ResultMessage) message() {}
 
+// PermissionDenial is a tool use that was denied permission during a turn.
+type PermissionDenial struct {
+	ToolName  string         `json:"tool_name"`
+	ToolUseID string         `json:"tool_use_id,omitempty"`
+	ToolInput map[string]any `json:"tool_input,omitempty"`
+}
+
+// Duration returns the total duration of the turn.
+func (m *ResultMessage) Duration() time.Duration {
+	return time.Duration(m.DurationMS) * time.Millisecond
+}
+
+// APIDuration returns the time spent in API calls during the turn.
+func (m *ResultMessage) APIDuration() time.Duration {
+	return time.Duration(m.DurationAPIMS) * time.Millisecond
+}
+
+// HitTurnLimit reports whether the turn ended because Options.MaxTurns was
+// reached. Such results have IsError set, but the conversation itself did
+// not fail and may be continued.
+func (m *ResultMessage) HitTurnLimit() bool {
+	return m.Subtype == "error_max_turns"
+}
+
+// WasTruncated reports whether the response was cut off by the output
+// token limit, in which case the caller may want to ask for a continuation.
+func (m *ResultMessage) WasTruncated() bool {
+	return m.StopReason == "max_tokens"
+}
+
+// StreamEvent is a raw API streaming event, such as a content block delta,
+// received when Options.IncludePartialMessages is set
+type StreamEvent struct {
+	UUID            string         `json:"uuid"`
+	SessionID       string         `json:"session_id"`
+	Event           map[string]any `json:"event"`
+	ParentToolUseID string         `json:"parent_tool_use_id,omitempty"`
+}
+
+func (StreamEvent) message() {}
+
+// ToolProgress reports that a tool, such as a long Bash command, is still
+// running, with the time elapsed since it started
+type ToolProgress struct {
+	ToolUseID       string  `json:"tool_use_id"`
+	ToolName        string  `json:"tool_name"`
+	ParentToolUseID string  `json:"parent_tool_use_id,omitempty"`
+	SessionID       string  `json:"session_id,omitempty"`
+	ElapsedSeconds  float64 `json:"elapsed_time_seconds"`
+	Status          string  `json:"status,omitempty"` // e.g. "running Bash...", when the CLI sends one
+	// ToolUse is the tool use reported on, set by ReceiveToolProgress once
+	// the assistant message requesting it has been seen
+	ToolUse *ToolUseBlock `json:"-"`
+}
+
+func (ToolProgress) message() {}
+
+// EventType returns the type of the wrapped event, e.g. "content_block_delta".
+func (m *StreamEvent) EventType() string {
+	eventType, _ := m.Event["type"].(string)
+	return eventType
+}
+
 // parseMessage parses a message from raw JSON data.
 func parseMessage(data map[string]any) (Message, error) {
 	msgType, ok := data["type"].(string)
@@ -153,17 +362,42 @@ func parseMessage(data map[string]any) (Message, error) {
 		return parseSystemMessage(data), nil
 	case "result":
 		return parseResultMessage(data), nil
+	case "stream_event":
+		return parseStreamEvent(data), nil
+	case "tool_progress":
+		return parseToolProgress(data), nil
+	case "ping", "keep_alive":
+		// Keepalives sent while the model is thinking
+		msg := &SystemMessage{Subtype: "ping"}
+		msg.Data, _ = data["data"].(map[string]any)
+		return msg, nil
 	default:
 		return nil, fmt.Errorf("unknown message type: %s", msgType)
 	}
 }
 
 func parseUserMessage(data map[string]any) (*UserMessage, error) {
-	content, ok := data["content"].(string)
-	if !ok {
+	// Check if message data is nested under "message" field
+	if msgData, ok := data["message"].(map[string]any); ok {
+		data = msgData
+	}
+
+	switch content := data["content"].(type) {
+	case string:
+		return &UserMessage{Content: content}, nil
+	case []any:
+		msg := &UserMessage{}
+		for _, item := range content {
+			block, err := parseContentBlock(item)
+			if err != nil {
+				return nil, err
+			}
+			msg.Blocks = append(msg.Blocks, block)
+		}
+		return msg, nil
+	default:
 		return nil, fmt.Errorf("invalid user message content")
 	}
-	return &UserMessage{Content: content}, nil
 }
 
 func parseAssistantMessage(data map[string]any) (*AssistantMessage, error) {
@@ -172,8 +406,9 @@ func parseAssistantMessage(data map[string]any) (*AssistantMessage, error) {
 		data = msgData
 	}
 	
+	// A message can carry no content, e.g. one that only reports a stop
 	contentData, ok := data["content"].([]any)
-	if !ok {
+	if !ok && data["content"] != nil {
 		return nil, fmt.Errorf("invalid assistant message content")
 	}
 
@@ -186,7 +421,13 @@ func parseAssistantMessage(data map[string]any) (*AssistantMessage, error) {
 		content = append(content, block)
 	}
 
-	return &AssistantMessage{Content: content}, nil
+	msg := &AssistantMessage{Content: content}
+	msg.ID, _ = data["id"].(string)
+	msg.Model, _ = data["model"].(string)
+	msg.StopReason, _ = data["stop_reason"].(string)
+	msg.StopSequence, _ = data["stop_sequence"].(string)
+
+	return msg, nil
 }
 
 func parseContentBlock(data any) (ContentBlock, error) {
@@ -214,6 +455,20 @@ func parseContentBlock(data any) (ContentBlock, error) {
 		input, _ := blockData["input"].(map[string]any)
 		return &ToolUseBlock{ID: id, Name: name, Input: input}, nil
 
+	case "image":
+		source, _ := blockData["source"].(map[string]any)
+		return &ImageBlock{Source: source}, nil
+
+	case "document":
+		source, _ := blockData["source"].(map[string]any)
+		block := &DocumentBlock{}
+		block.SourceType, _ = source["type"].(string)
+		block.MediaType, _ = source["media_type"].(string)
+		block.Data, _ = source["data"].(string)
+		block.Path, _ = source["path"].(string)
+		block.Title, _ = blockData["title"].(string)
+		return block, nil
+
 	case "tool_result":
 		toolUseID, _ := blockData["tool_use_id"].(string)
 		content := blockData["content"]
@@ -223,10 +478,14 @@ func parseContentBlock(data any) (ContentBlock, error) {
 			isError = &val
 		}
 
+		partial, _ := blockData["partial"].(bool)
+
 		return &ToolResultBlock{
 			ToolUseID: toolUseID,
 			Content:   content,
 			IsError:   isError,
+			Partial:   partial,
+			Blocks:    parseNestedContentBlocks(content),
 		}, nil
 
 	default:
@@ -234,10 +493,61 @@ func parseContentBlock(data any) (ContentBlock, error) {
 	}
 }
 
+// parseNestedContentBlocks parses tool result content given as a block
+// array. It returns nil for string content or when any item is not a
+// recognizable block, leaving the raw content as the only representation.
+func parseNestedContentBlocks(content any) []ContentBlock {
+	items, ok := content.([]any)
+	if !ok || len(items) == 0 {
+		return nil
+	}
+
+	blocks := make([]ContentBlock, 0, len(items))
+	for _, item := range items {
+		block, err := parseContentBlock(item)
+		if err != nil {
+			return nil
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
 func parseSystemMessage(data map[string]any) *SystemMessage {
-	subtype, _ := data["subtype"].(string)
-	msgData, _ := data["data"].(map[string]any)
-	return &SystemMessage{Subtype: subtype, Data: msgData}
+	msg := &SystemMessage{}
+	msg.Subtype, _ = data["subtype"].(string)
+	msg.Data, _ = data["data"].(map[string]any)
+
+	// Messages such as init carry their fields at the top level
+	msg.SessionID, _ = data["session_id"].(string)
+	msg.WorkingDir, _ = data["cwd"].(string)
+	for _, key := range []string{"claude_code_version", "version"} {
+		if version, ok := data[key].(string); ok {
+			msg.Version = version
+			break
+		}
+	}
+	return msg
+}
+
+func parseStreamEvent(data map[string]any) *StreamEvent {
+	msg := &StreamEvent{}
+	msg.UUID, _ = data["uuid"].(string)
+	msg.SessionID, _ = data["session_id"].(string)
+	msg.Event, _ = data["event"].(map[string]any)
+	msg.ParentToolUseID, _ = data["parent_tool_use_id"].(string)
+	return msg
+}
+
+func parseToolProgress(data map[string]any) *ToolProgress {
+	msg := &ToolProgress{}
+	msg.ToolUseID, _ = data["tool_use_id"].(string)
+	msg.ToolName, _ = data["tool_name"].(string)
+	msg.ParentToolUseID, _ = data["parent_tool_use_id"].(string)
+	msg.SessionID, _ = data["session_id"].(string)
+	msg.ElapsedSeconds, _ = data["elapsed_time_seconds"].(float64)
+	msg.Status, _ = data["status"].(string)
+	return msg
 }
 
 func parseResultMessage(data map[string]any) *ResultMessage {
@@ -271,6 +581,48 @@ func parseResultMessage(data map[string]any) *ResultMessage {
 		msg.Result = &val
 	}
 
+	msg.StopReason, _ = data["stop_reason"].(string)
+
+	// Failed turns describe the error as {"type": ..., "message": ...}, or
+	// occasionally as a plain string
+	switch errData := data["error"].(type) {
+	case map[string]any:
+		msg.ErrorType, _ = errData["type"].(string)
+		msg.ErrorMessage, _ = errData["message"].(string)
+	case string:
+		msg.ErrorMessage = errData
+	}
+
+	// The tier is reported in usage, or alongside it by some CLI versions
+	if val, ok := data["service_tier"].(string); ok {
+		msg.ServiceTier = val
+	} else if val, ok := msg.Usage["service_tier"].(string); ok {
+		msg.ServiceTier = val
+	}
+
+	if denials, ok := data["permission_denials"].([]any); ok {
+		for _, item := range denials {
+			denialData, ok := item.(map[string]any)
+			if !ok {
+				continue
+			}
+			denial := PermissionDenial{}
+			denial.ToolName, _ = denialData["tool_name"].(string)
+			denial.ToolUseID, _ = denialData["tool_use_id"].(string)
+			denial.ToolInput, _ = denialData["tool_input"].(map[string]any)
+			msg.PermissionDenials = append(msg.PermissionDenials, denial)
+		}
+	}
+
+	if metadata, ok := data["metadata"].(map[string]any); ok {
+		msg.Metadata = make(map[string]string, len(metadata))
+		for key, value := range metadata {
+			if s, ok := value.(string); ok {
+				msg.Metadata[key] = s
+			}
+		}
+	}
+
 	return msg
 }
 
@@ -278,4 +630,6 @@ func parseResultMessage(data map[string]any) *ResultMessage {
 type MessageResult struct {
 	Message Message
 	Error   error
+	// Replayed is true for historical messages queued via Client.Replay
+	Replayed bool
 }